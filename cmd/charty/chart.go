@@ -27,14 +27,18 @@ import (
 	getter "helm.sh/helm/v3/pkg/getter"
 )
 
-func mergeOptions(valuesFiles, set []string) map[string]interface{} {
+func mergeValues(valuesFiles, set []string) (map[string]interface{}, error) {
 	provider := getter.Provider{
 		Schemes: []string{"http", "https"},
 		New:     getter.NewHTTPGetter,
 	}
 	opts := helmoptions.Options{ValueFiles: valuesFiles, Values: set}
 
-	res, err := opts.MergeValues(getter.Providers{provider})
+	return opts.MergeValues(getter.Providers{provider})
+}
+
+func mergeOptions(valuesFiles, set []string) map[string]interface{} {
+	res, err := mergeValues(valuesFiles, set)
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
@@ -57,6 +61,74 @@ func runtimeOptions(merged map[string]interface{}) runner.Options {
 	return startOptions
 }
 
+func outputSink(mode string) runner.OutputSink {
+	switch mode {
+	case "stream":
+		return runner.StdSink
+	case "prefix":
+		return &runner.PrefixSink{Out: os.Stdout, Err: os.Stderr}
+	case "none":
+		return runner.DiscardSink
+	}
+	log.Error("Invalid output mode '" + mode + "', must be one of stream, prefix or none")
+	os.Exit(1)
+	return nil
+}
+
+// cliOptions returns the runtime options given from the cli
+func cliOptions(runFiles, run []string) runner.Options {
+	startOptions := runtimeOptions(mergeOptions(runFiles, run))
+	if parallel := viper.GetInt("parallel"); parallel > 0 {
+		startOptions.Parallel = parallel
+	}
+	if rerun := viper.GetInt("rerun-failed"); rerun > 0 {
+		startOptions.RerunFailed = rerun
+	}
+	if viper.GetBool("fail-fast") {
+		startOptions.FailFast = true
+	}
+	if viper.GetBool("shuffle") {
+		startOptions.Shuffle = true
+	}
+	if seed := viper.GetInt64("shuffle-seed"); seed != 0 {
+		startOptions.ShuffleSeed = seed
+	}
+	if focus := viper.GetString("focus"); len(focus) > 0 {
+		startOptions.Focus = focus
+	}
+	if skip := viper.GetString("skip"); len(skip) > 0 {
+		startOptions.Skip = skip
+	}
+	if tags := viper.GetStringSlice("tags"); len(tags) > 0 {
+		startOptions.Tags = tags
+	}
+	if tags := viper.GetStringSlice("exclude-tags"); len(tags) > 0 {
+		startOptions.ExcludeTags = tags
+	}
+	if host := viper.GetString("ssh-host"); len(host) > 0 {
+		startOptions.Executor = "ssh"
+		startOptions.SSH.Host = host
+	}
+	if user := viper.GetString("ssh-user"); len(user) > 0 {
+		startOptions.SSH.User = user
+	}
+	if key := viper.GetString("ssh-key"); len(key) > 0 {
+		startOptions.SSH.Key = key
+	}
+	env, err := runner.ParseEnv(viper.GetStringSlice("env"))
+	if err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if startOptions.Env == nil {
+		startOptions.Env = map[string]string{}
+	}
+	for k, v := range env {
+		startOptions.Env[k] = v
+	}
+	return startOptions
+}
+
 var startCmd = &cobra.Command{
 	Use:     "start [CHART1] [CHART2] [flags]",
 	Short:   "start a runnable helm-templated chart!",
@@ -94,6 +166,23 @@ set for a key called 'foo', the 'newbar' value would take precedence:
 		viper.BindPFlag("run", cmd.Flags().Lookup("run"))
 		viper.BindPFlag("runner-dir", cmd.Flags().Lookup("runner-dir"))
 		viper.BindPFlag("run-files", cmd.Flags().Lookup("run-files"))
+		viper.BindPFlag("parallel", cmd.Flags().Lookup("parallel"))
+		viper.BindPFlag("rerun-failed", cmd.Flags().Lookup("rerun-failed"))
+		viper.BindPFlag("env", cmd.Flags().Lookup("env"))
+		viper.BindPFlag("fail-fast", cmd.Flags().Lookup("fail-fast"))
+		viper.BindPFlag("output", cmd.Flags().Lookup("output"))
+		viper.BindPFlag("ssh-host", cmd.Flags().Lookup("ssh-host"))
+		viper.BindPFlag("ssh-user", cmd.Flags().Lookup("ssh-user"))
+		viper.BindPFlag("ssh-key", cmd.Flags().Lookup("ssh-key"))
+		viper.BindPFlag("count", cmd.Flags().Lookup("count"))
+		viper.BindPFlag("until-failure", cmd.Flags().Lookup("until-failure"))
+		viper.BindPFlag("shuffle", cmd.Flags().Lookup("shuffle"))
+		viper.BindPFlag("shuffle-seed", cmd.Flags().Lookup("shuffle-seed"))
+		viper.BindPFlag("focus", cmd.Flags().Lookup("focus"))
+		viper.BindPFlag("skip", cmd.Flags().Lookup("skip"))
+		viper.BindPFlag("tags", cmd.Flags().Lookup("tags"))
+		viper.BindPFlag("exclude-tags", cmd.Flags().Lookup("exclude-tags"))
+		viper.BindPFlag("list", cmd.Flags().Lookup("list"))
 
 	},
 	Run: func(cmd *cobra.Command, args []string) {
@@ -103,27 +192,30 @@ set for a key called 'foo', the 'newbar' value would take precedence:
 		valuesFiles := viper.GetStringSlice("values")
 		runnerDir := viper.GetString("runner-dir")
 
-		startOptions := runtimeOptions(mergeOptions(runFiles, run))
+		startOptions := cliOptions(runFiles, run)
 		mergeOpts := mergeOptions(valuesFiles, set)
 
-		testrunner := &runner.TestRunner{}
-		for _, a := range args {
-			errors := 0
-			tests := 0
+		ctx, cancel := signalContext()
+		defer cancel()
 
+		testrunner := &runner.TestRunner{Output: outputSink(viper.GetString("output"))}
+		for _, a := range args {
 			testchart := &test.TestChart{Values: mergeOpts}
 			if len(runnerDir) > 0 {
 				testchart.SetRunnerDirectory(runnerDir)
 			}
+			cleanup := func() {
+				if len(runnerDir) == 0 {
+					testchart.Cleanup()
+				}
+			}
 
-			err := testchart.Load(a)
+			err := testchart.Load(ctx, a)
 			if err != nil {
 				log.Error(err)
+				cleanup()
 				os.Exit(1)
 			}
-			if len(runnerDir) == 0 {
-				defer testchart.Cleanup()
-			}
 
 			log.WithFields(log.Fields{
 				"name":    testchart.Name(),
@@ -145,38 +237,21 @@ set for a key called 'foo', the 'newbar' value would take precedence:
 
 			log.Info("===========")
 
-			out, err := testrunner.Run(testchart, startOptions)
-			scripts := len(out)
-			var totalTime float64
-
-			for _, r := range out {
-				if r.Testrun {
-					tests++
+			if viper.GetBool("list") {
+				out, err := testrunner.List(testchart, startOptions)
+				cleanup()
+				if err != nil {
+					log.Error(err)
+					os.Exit(1)
 				}
-
-				if r.Error != nil {
-					errors++
-				}
-				totalTime += r.Elapsed
+				listing(out)
+				continue
 			}
 
-			log.Info("===========")
-
-			if err != nil {
-				log.WithFields(log.Fields{
-					"errors":        errors,
-					"scripts":       scripts,
-					"tests":         tests,
-					"total_time(s)": totalTime,
-				}).Error("Error summary\n" + err.Error())
+			success := repeat(ctx, testrunner, testchart, startOptions, viper.GetInt("count"), viper.GetBool("until-failure"))
+			cleanup()
+			if !success {
 				os.Exit(1)
-			} else {
-				log.WithFields(log.Fields{
-					"errors":        errors,
-					"scripts":       scripts,
-					"tests":         tests,
-					"total_time(s)": totalTime,
-				}).Info("Success!")
 			}
 		}
 	},
@@ -189,5 +264,22 @@ func init() {
 	startCmd.Flags().StringSliceP("values", "f", []string{}, "specify values in a YAML file or a URL (can specify multiple)")
 	startCmd.Flags().StringP("runner-dir", "d", "", "specify a directory where your test execution will run")
 
+	startCmd.Flags().Int("parallel", 0, "maximum number of commands to run concurrently (commands still wait for the ones listed in their 'needs')")
+	startCmd.Flags().Int("rerun-failed", 0, "run again the failed commands up to N times once all the commands ran")
+	startCmd.Flags().StringSlice("env", []string{}, "set environment variables for the commands, as KEY=VAL (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	startCmd.Flags().Bool("fail-fast", false, "stop the run at the first failing command (global post commands still run)")
+	startCmd.Flags().String("output", "stream", "how to stream the output of the commands while they run: stream, prefix (with the command name) or none")
+	startCmd.Flags().String("ssh-host", "", "run the commands on a host over ssh, as host or host:port (the runner directory is copied there)")
+	startCmd.Flags().String("ssh-user", "", "user to connect to the ssh host as")
+	startCmd.Flags().String("ssh-key", "", "private key to authenticate to the ssh host with")
+	startCmd.Flags().Int("count", 0, "run the chart N times in the same runner directory, and report the results of every command over the runs")
+	startCmd.Flags().Bool("until-failure", false, "run the chart until a run fails (at most --count times, if given)")
+	startCmd.Flags().Bool("shuffle", false, "start the commands in a random order, which still follows their 'needs' (the seed is printed)")
+	startCmd.Flags().Int64("shuffle-seed", 0, "shuffle the commands with the given seed, to replay the order of a previous run")
+	startCmd.Flags().String("focus", "", "run only the commands whose name matches the regular expression (and the ones they need)")
+	startCmd.Flags().String("skip", "", "do not run the commands whose name matches the regular expression")
+	startCmd.Flags().StringSlice("tags", []string{}, "run only the commands matching one of the tag expressions, as a+b for both tags and !a without it (and the ones they need)")
+	startCmd.Flags().StringSlice("exclude-tags", []string{}, "do not run the commands matching one of the tag expressions, as for --tags")
+	startCmd.Flags().Bool("list", false, "list the commands which would run and the ones filtered out, without running them")
 	RootCmd.AddCommand(startCmd)
 }
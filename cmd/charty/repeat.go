@@ -0,0 +1,82 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mudler/charty/pkg/runner"
+	test "github.com/mudler/charty/pkg/testchart"
+	log "github.com/sirupsen/logrus"
+)
+
+// repeat runs the chart count times in the same runner directory, or until
+// a run fails with untilFailure, at most count times if set. It logs the
+// results of every command over the runs, and returns false if any failed.
+func repeat(ctx context.Context, testrunner *runner.TestRunner, testchart *test.TestChart, o runner.Options, count int, untilFailure bool) bool {
+	if count <= 1 && !untilFailure {
+		out, err := testrunner.Run(ctx, testchart, o)
+		return summary(out, err)
+	}
+
+	runs := [][]runner.CommandOutput{}
+	success := true
+	for i := 0; (count < 1 || i < count) && ctx.Err() == nil; i++ {
+		log.WithField("run", i+1).Info("Starting run")
+		out, err := testrunner.Run(ctx, testchart, o)
+		runs = append(runs, out)
+		if !summary(out, err) {
+			success = false
+			if untilFailure {
+				log.WithField("run", i+1).Warn("Stopping at the first failed run")
+				break
+			}
+		}
+	}
+
+	statsSummary(runner.Stats(runs))
+	return success
+}
+
+// statsSummary logs the results of every command over repeated runs
+func statsSummary(stats []runner.CommandStats) {
+	log.Info("===========")
+	for _, s := range stats {
+		entry := log.WithFields(log.Fields{
+			"name":      s.Name,
+			"runs":      s.Runs,
+			"passed":    s.Passed,
+			"flaky":     s.Flaky,
+			"failed":    s.Failed,
+			"not_run":   s.Skipped,
+			"pass_rate": fmt.Sprintf("%.1f%%", s.PassRate()*100),
+			"min(s)":    s.Percentile(0),
+			"median(s)": s.Percentile(50),
+			"p90(s)":    s.Percentile(90),
+			"max(s)":    s.Percentile(100),
+			"mean(s)":   s.Mean(),
+		})
+		switch {
+		case s.Unstable():
+			entry.Warn("Unstable")
+		case s.Failed > 0:
+			entry.Error("Failed in every run")
+		case s.Skipped == s.Runs:
+			entry.Warn("Not run")
+		default:
+			entry.Info("Passed in every run")
+		}
+	}
+}
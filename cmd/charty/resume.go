@@ -62,18 +62,26 @@ It can be used to run output of previous charty run against the same output dire
 		viper.BindPFlag("values", cmd.Flags().Lookup("values"))
 		viper.BindPFlag("run", cmd.Flags().Lookup("run"))
 		viper.BindPFlag("run-files", cmd.Flags().Lookup("run-files"))
+		viper.BindPFlag("parallel", cmd.Flags().Lookup("parallel"))
+		viper.BindPFlag("rerun-failed", cmd.Flags().Lookup("rerun-failed"))
+		viper.BindPFlag("env", cmd.Flags().Lookup("env"))
+		viper.BindPFlag("fail-fast", cmd.Flags().Lookup("fail-fast"))
+		viper.BindPFlag("output", cmd.Flags().Lookup("output"))
+		viper.BindPFlag("ssh-host", cmd.Flags().Lookup("ssh-host"))
+		viper.BindPFlag("ssh-user", cmd.Flags().Lookup("ssh-user"))
+		viper.BindPFlag("ssh-key", cmd.Flags().Lookup("ssh-key"))
 
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		run := viper.GetStringSlice("run")
 		runFiles := viper.GetStringSlice("run-files")
-		startOptions := runtimeOptions(mergeOptions(runFiles, run))
+		startOptions := cliOptions(runFiles, run)
 
-		testrunner := &runner.TestRunner{}
-		for _, a := range args {
-			errors := 0
-			tests := 0
+		ctx, cancel := signalContext()
+		defer cancel()
 
+		testrunner := &runner.TestRunner{Output: outputSink(viper.GetString("output"))}
+		for _, a := range args {
 			testchart := &test.TestChart{Values: map[string]interface{}{}}
 			err := testchart.LoadMeta(a)
 			if err != nil {
@@ -102,38 +110,9 @@ It can be used to run output of previous charty run against the same output dire
 
 			log.Info("===========")
 
-			out, err := testrunner.Run(testchart, startOptions)
-			scripts := len(out)
-			var totalTime float64
-
-			for _, r := range out {
-				if r.Testrun {
-					tests++
-				}
-
-				if r.Error != nil {
-					errors++
-				}
-				totalTime += r.Elapsed
-			}
-
-			log.Info("===========")
-
-			if err != nil {
-				log.WithFields(log.Fields{
-					"errors":        errors,
-					"scripts":       scripts,
-					"tests":         tests,
-					"total_time(s)": totalTime,
-				}).Error("Error summary\n" + err.Error())
+			out, err := testrunner.Run(ctx, testchart, startOptions)
+			if !summary(out, err) {
 				os.Exit(1)
-			} else {
-				log.WithFields(log.Fields{
-					"errors":        errors,
-					"scripts":       scripts,
-					"tests":         tests,
-					"total_time(s)": totalTime,
-				}).Info("Success!")
 			}
 		}
 	},
@@ -143,5 +122,13 @@ func init() {
 	resumeCmd.Flags().StringSlice("run", []string{}, "set runtime values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
 	resumeCmd.Flags().StringSlice("run-files", []string{}, "specify runtimes values in a YAML file or a URL (can specify multiple)")
 
+	resumeCmd.Flags().Int("parallel", 0, "maximum number of commands to run concurrently (commands still wait for the ones listed in their 'needs')")
+	resumeCmd.Flags().Int("rerun-failed", 0, "run again the failed commands up to N times once all the commands ran")
+	resumeCmd.Flags().StringSlice("env", []string{}, "set environment variables for the commands, as KEY=VAL (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	resumeCmd.Flags().Bool("fail-fast", false, "stop the run at the first failing command (global post commands still run)")
+	resumeCmd.Flags().String("output", "stream", "how to stream the output of the commands while they run: stream, prefix (with the command name) or none")
+	resumeCmd.Flags().String("ssh-host", "", "run the commands on a host over ssh, as host or host:port (the runner directory is copied there)")
+	resumeCmd.Flags().String("ssh-user", "", "user to connect to the ssh host as")
+	resumeCmd.Flags().String("ssh-key", "", "private key to authenticate to the ssh host with")
 	RootCmd.AddCommand(resumeCmd)
 }
@@ -0,0 +1,46 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// signalContext returns a context which is cancelled on SIGINT or SIGTERM.
+// A second signal exits immediately.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Warn("Received " + sig.String() + ", stopping commands and running cleanup. Send it again to exit immediately")
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		<-sigs
+		log.Error("Exiting without cleanup")
+		os.Exit(130)
+	}()
+
+	return ctx, cancel
+}
@@ -0,0 +1,112 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"strings"
+
+	units "github.com/docker/go-units"
+	"github.com/mudler/charty/pkg/runner"
+	log "github.com/sirupsen/logrus"
+)
+
+// summary logs the results of a chart run, and returns false if it failed
+func summary(out []runner.CommandOutput, err error) bool {
+	errors := 0
+	tests := 0
+	skipped := 0
+	timeouts := 0
+	ignored := 0
+	interrupted := 0
+	flaky := []string{}
+	scripts := len(out)
+	var totalTime float64
+	var usage runner.Usage
+
+	for _, r := range out {
+		if r.Testrun {
+			tests++
+		}
+
+		if r.Failed() {
+			errors++
+		} else if r.Error != nil {
+			ignored++
+		}
+		if r.Skipped {
+			skipped++
+		}
+		if r.TimedOut {
+			timeouts++
+		}
+		if r.Interrupted {
+			interrupted++
+		}
+		if r.Flaky() {
+			flaky = append(flaky, r.Command.Name)
+		}
+		totalTime += r.Elapsed
+		usage = usage.Add(r.Usage)
+	}
+
+	log.Info("===========")
+
+	fields := log.Fields{
+		"errors":        errors,
+		"scripts":       scripts,
+		"tests":         tests,
+		"not_run":       skipped,
+		"timeouts":      timeouts,
+		"interrupted":   interrupted,
+		"ignored":       ignored,
+		"flaky":         strings.Join(flaky, ","),
+		"total_time(s)": totalTime,
+		"cpu_time(s)":   usage.CPUTime().Seconds(),
+		"max_rss":       units.BytesSize(float64(usage.MaxRSS)),
+	}
+	if len(out) > 0 && out[0].ShuffleSeed != 0 {
+		fields["shuffle_seed"] = out[0].ShuffleSeed
+	}
+	if err != nil {
+		log.WithFields(fields).Error("Error summary\n" + err.Error())
+		return false
+	}
+
+	log.WithFields(fields).Info("Success!")
+	return true
+}
+
+// listing logs the commands a run would run, and the ones filtered out
+func listing(out []runner.CommandOutput) {
+	selected := 0
+	for _, r := range out {
+		fields := log.Fields{
+			"name":    r.Command.Name,
+			"command": r.Command.Run,
+			"tags":    strings.Join(r.Command.Tags, ","),
+		}
+		if r.Skipped {
+			log.WithFields(fields).Warn("Not selected: " + r.SkipReason)
+			continue
+		}
+		selected++
+		log.WithFields(fields).Info("Selected")
+	}
+
+	log.Info("===========")
+	log.WithFields(log.Fields{
+		"selected":     selected,
+		"not_selected": len(out) - selected,
+	}).Info("Listing")
+}
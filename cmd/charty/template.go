@@ -14,6 +14,7 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"os"
 
 	test "github.com/mudler/charty/pkg/testchart"
@@ -33,7 +34,7 @@ var templateCmd = &cobra.Command{
 		}
 		testchart := &test.TestChart{}
 		defer testchart.Cleanup()
-		err := testchart.Load(args[0])
+		err := testchart.Load(context.Background(), args[0])
 		if err != nil {
 			log.Error(err)
 			os.Exit(1)
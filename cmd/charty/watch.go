@@ -0,0 +1,336 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mudler/charty/pkg/runner"
+	test "github.com/mudler/charty/pkg/testchart"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// chartWatcher reports the changes to the files of a chart directory and
+// to the values files
+type chartWatcher struct {
+	watcher  *fsnotify.Watcher
+	chart    string
+	values   map[string]bool
+	debounce time.Duration
+}
+
+func newChartWatcher(chart string, valuesFiles []string, debounce time.Duration) (*chartWatcher, error) {
+	chart, err := filepath.Abs(chart)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(chart); err != nil || !info.IsDir() {
+		return nil, errors.Errorf("'%s' is not a chart directory", chart)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "while creating watcher")
+	}
+	w := &chartWatcher{watcher: watcher, chart: chart, values: map[string]bool{}, debounce: debounce}
+	if err := watcher.Add(chart); err != nil {
+		w.Close()
+		return nil, errors.Wrap(err, "while watching chart")
+	}
+	for _, d := range []string{"templates", "static"} {
+		if err := w.addTree(filepath.Join(chart, d)); err != nil {
+			w.Close()
+			return nil, errors.Wrap(err, "while watching chart")
+		}
+	}
+
+	// Files are replaced by many editors, their directory is watched
+	for _, f := range valuesFiles {
+		if strings.Contains(f, "://") {
+			continue
+		}
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.values[abs] = true
+		if err := watcher.Add(filepath.Dir(abs)); err != nil {
+			w.Close()
+			return nil, errors.Wrapf(err, "while watching values file '%s'", f)
+		}
+	}
+	return w, nil
+}
+
+func (w *chartWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// addTree watches a directory and its subdirectories, if it exists
+func (w *chartWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return w.watcher.Add(p)
+		}
+		return nil
+	})
+}
+
+// change returns the path in the runner directory of a changed file of the
+// chart, or all if it affects all the commands. Files which are not part
+// of the chart, and the hidden and backup files of editors, are ignored.
+func (w *chartWatcher) change(name string) (path string, all, ok bool) {
+	if w.values[name] {
+		return "", true, true
+	}
+	rel, err := filepath.Rel(w.chart, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false, false
+	}
+	if base := filepath.Base(rel); strings.HasPrefix(base, ".") || strings.HasSuffix(base, "~") {
+		return "", false, false
+	}
+
+	sep := string(filepath.Separator)
+	switch {
+	case rel == "values.yaml", rel == "runtime.yaml", rel == "metadata.yaml", rel == "templates", rel == "static":
+		return "", true, true
+	case strings.HasPrefix(rel, "templates"+sep):
+		return filepath.ToSlash(strings.TrimPrefix(rel, "templates"+sep)), false, true
+	case strings.HasPrefix(rel, "static"+sep):
+		return filepath.ToSlash(rel), false, true
+	}
+	return "", false, false
+}
+
+// source returns the file of the chart a path in the runner directory is
+// rendered or copied from
+func (w *chartWatcher) source(path string) string {
+	if strings.HasPrefix(path, "static/") {
+		return filepath.Join(w.chart, filepath.FromSlash(path))
+	}
+	return filepath.Join(w.chart, "templates", filepath.FromSlash(path))
+}
+
+// next waits for changes to the chart, until none happens for the debounce
+// period. It returns the changed paths in the runner directory, and if any
+// change affects all the commands.
+func (w *chartWatcher) next(ctx context.Context) ([]string, bool, error) {
+	changed := map[string]bool{}
+	all := false
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case err := <-w.watcher.Errors:
+			log.Warn("Error watching the chart: " + err.Error())
+		case e := <-w.watcher.Events:
+			if e.Op == fsnotify.Chmod {
+				continue
+			}
+			if e.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(e.Name); err == nil && info.IsDir() {
+					if err := w.addTree(e.Name); err != nil {
+						log.Warn("Can't watch '" + e.Name + "': " + err.Error())
+					}
+				}
+			}
+			path, a, ok := w.change(e.Name)
+			if !ok {
+				continue
+			}
+			if a {
+				all = true
+			} else {
+				changed[path] = true
+			}
+			timer = time.After(w.debounce)
+		case <-timer:
+			paths := []string{}
+			for p := range changed {
+				paths = append(paths, p)
+			}
+			sort.Strings(paths)
+			return paths, all, nil
+		}
+	}
+}
+
+// watchRun renders the chart in the runner directory and runs it. Errors
+// are logged, as watching goes on.
+func watchRun(ctx context.Context, testrunner *runner.TestRunner, testchart *test.TestChart, chartpath string, valuesFiles, set []string, o runner.Options) {
+	values, err := mergeValues(valuesFiles, set)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	testchart.Values = values
+	if err := testchart.Load(ctx, chartpath); err != nil {
+		log.Error(err)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"name":    testchart.Name(),
+		"version": testchart.Version(),
+		"chart":   chartpath,
+	}).Info("Starting chart")
+
+	log.Info("===========")
+
+	out, err := testrunner.Run(ctx, testchart, o)
+	summary(out, err)
+}
+
+var watchCmd = &cobra.Command{
+	Use:   "watch [CHART] [flags]",
+	Short: "run a chart again whenever it changes",
+	Long: `This command starts a chart, and runs it again whenever its templates,
+static files, values.yaml, runtime.yaml or the values files given with
+'--values'/'-f' change.
+
+The start argument must be a path to an unpacked chart directory. Changes are
+collected until none happens for the '--debounce' period, then the running
+commands are stopped and the chart is rendered and run again.
+
+With '--affected' only the commands referring to the changed files run again,
+with the commands they need and the ones needing them. All the commands run
+when values.yaml, runtime.yaml or a values file change.
+
+    $ charty watch --affected -f myvalues.yaml ./tests
+`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("set", cmd.Flags().Lookup("set"))
+		viper.BindPFlag("values", cmd.Flags().Lookup("values"))
+		viper.BindPFlag("run", cmd.Flags().Lookup("run"))
+		viper.BindPFlag("runner-dir", cmd.Flags().Lookup("runner-dir"))
+		viper.BindPFlag("run-files", cmd.Flags().Lookup("run-files"))
+		viper.BindPFlag("parallel", cmd.Flags().Lookup("parallel"))
+		viper.BindPFlag("rerun-failed", cmd.Flags().Lookup("rerun-failed"))
+		viper.BindPFlag("env", cmd.Flags().Lookup("env"))
+		viper.BindPFlag("fail-fast", cmd.Flags().Lookup("fail-fast"))
+		viper.BindPFlag("output", cmd.Flags().Lookup("output"))
+		viper.BindPFlag("ssh-host", cmd.Flags().Lookup("ssh-host"))
+		viper.BindPFlag("ssh-user", cmd.Flags().Lookup("ssh-user"))
+		viper.BindPFlag("ssh-key", cmd.Flags().Lookup("ssh-key"))
+		viper.BindPFlag("debounce", cmd.Flags().Lookup("debounce"))
+		viper.BindPFlag("affected", cmd.Flags().Lookup("affected"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			log.Error("Need 1 argument, the chart directory")
+			os.Exit(1)
+		}
+		set := viper.GetStringSlice("set")
+		run := viper.GetStringSlice("run")
+		runFiles := viper.GetStringSlice("run-files")
+		valuesFiles := viper.GetStringSlice("values")
+		runnerDir := viper.GetString("runner-dir")
+		affected := viper.GetBool("affected")
+
+		startOptions := cliOptions(runFiles, run)
+
+		ctx, cancel := signalContext()
+		defer cancel()
+
+		w, err := newChartWatcher(args[0], valuesFiles, viper.GetDuration("debounce"))
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		defer w.Close()
+
+		testrunner := &runner.TestRunner{Output: outputSink(viper.GetString("output"))}
+		testchart := &test.TestChart{}
+		if len(runnerDir) > 0 {
+			testchart.SetRunnerDirectory(runnerDir)
+		} else {
+			defer testchart.Cleanup()
+		}
+
+		for {
+			runCtx, stop := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func(o runner.Options) {
+				defer close(done)
+				watchRun(runCtx, testrunner, testchart, w.chart, valuesFiles, set, o)
+				if runCtx.Err() == nil {
+					log.Info("Waiting for changes")
+				}
+			}(startOptions)
+
+			changed, all, err := w.next(ctx)
+			stop()
+			<-done
+			if err != nil {
+				return
+			}
+
+			// Files removed from the chart are removed from the runner
+			// directory as well
+			for _, p := range changed {
+				if _, err := os.Stat(w.source(p)); os.IsNotExist(err) && len(testchart.RunnerDirectory()) > 0 {
+					os.RemoveAll(filepath.Join(testchart.RunnerDirectory(), filepath.FromSlash(p)))
+				}
+			}
+
+			startOptions.Changed = nil
+			if affected && !all {
+				startOptions.Changed = changed
+			}
+			if len(startOptions.Changed) > 0 {
+				log.WithField("changed", strings.Join(changed, ",")).Info("Chart changed, running the affected commands again")
+			} else {
+				log.Info("Chart changed, running it again")
+			}
+		}
+	},
+}
+
+func init() {
+	watchCmd.Flags().StringSliceP("set", "s", []string{}, "set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	watchCmd.Flags().StringSlice("run", []string{}, "set runtime values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	watchCmd.Flags().StringSlice("run-files", []string{}, "specify runtimes values in a YAML file or a URL (can specify multiple)")
+	watchCmd.Flags().StringSliceP("values", "f", []string{}, "specify values in a YAML file or a URL (can specify multiple, local files are watched)")
+	watchCmd.Flags().StringP("runner-dir", "d", "", "specify a directory where your test execution will run")
+
+	watchCmd.Flags().Int("parallel", 0, "maximum number of commands to run concurrently (commands still wait for the ones listed in their 'needs')")
+	watchCmd.Flags().Int("rerun-failed", 0, "run again the failed commands up to N times once all the commands ran")
+	watchCmd.Flags().StringSlice("env", []string{}, "set environment variables for the commands, as KEY=VAL (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	watchCmd.Flags().Bool("fail-fast", false, "stop the run at the first failing command (global post commands still run)")
+	watchCmd.Flags().String("output", "stream", "how to stream the output of the commands while they run: stream, prefix (with the command name) or none")
+	watchCmd.Flags().String("ssh-host", "", "run the commands on a host over ssh, as host or host:port (the runner directory is copied there)")
+	watchCmd.Flags().String("ssh-user", "", "user to connect to the ssh host as")
+	watchCmd.Flags().String("ssh-key", "", "private key to authenticate to the ssh host with")
+	watchCmd.Flags().Duration("debounce", 300*time.Millisecond, "wait for no change to happen for this long before running the chart again")
+	watchCmd.Flags().Bool("affected", false, "run again only the commands referring to the changed files, with the ones they need and the ones needing them")
+	RootCmd.AddCommand(watchCmd)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// references reports whether the command refers to the path, relative to
+// the runner directory, in its commands or in its files. Paths inside of
+// the working directory of the command can be relative to it.
+func (c Command) references(path string) bool {
+	paths := []string{path}
+	if len(c.Dir) > 0 {
+		if rel, err := filepath.Rel(c.Dir, path); err == nil && !strings.HasPrefix(rel, "..") {
+			paths = append(paths, rel)
+		}
+	}
+
+	fields := append([]string{c.Pre, c.Run, c.Post, c.OnSuccess, c.OnFailure, c.Always, c.Script, c.Stdin, c.StdinFile}, c.EnvFiles...)
+	for _, p := range paths {
+		for _, f := range fields {
+			if containsPath(f, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pathBoundary are the characters which can surround a path in a command
+const pathBoundary = " \t\n'\"`/;&|<>()=:"
+
+// containsPath reports whether s refers to the path, which is found in it
+// surrounded by path boundaries rather than as part of a longer name.
+func containsPath(s, path string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	for i := 0; ; {
+		j := strings.Index(s[i:], path)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(path)
+		if (start == 0 || strings.IndexByte(pathBoundary, s[start-1]) >= 0) &&
+			(end == len(s) || strings.IndexByte(pathBoundary, s[end]) >= 0) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// affected returns the names of the commands referring to the changed
+// paths, with the ones needing them and all the ones they need, so they
+// can run on their own. It's empty if no command refers to the paths.
+func (l Commands) affected(changed []string) map[string]bool {
+	res := map[string]bool{}
+	for _, c := range l {
+		for _, p := range changed {
+			if c.references(p) {
+				res[c.Name] = true
+			}
+		}
+	}
+	if len(res) == 0 {
+		return res
+	}
+
+	// Commands needing the affected ones
+	for added := true; added; {
+		added = false
+		for _, c := range l {
+			for _, n := range c.Needs {
+				if res[n] && !res[c.Name] {
+					res[c.Name] = true
+					added = true
+				}
+			}
+		}
+	}
+
+	l.withNeeds(res, nil)
+	return res
+}
+
+// withNeeds adds to the set the names of the commands needed by the ones in
+// it, recursively, if keep is nil or returns true for them. Commands are
+// validated, so there are no cycles.
+func (l Commands) withNeeds(set map[string]bool, keep func(Command) bool) {
+	index := map[string]Command{}
+	for _, c := range l {
+		index[c.Name] = c
+	}
+	var need func(name string)
+	need = func(name string) {
+		for _, n := range index[name].Needs {
+			if !set[n] && (keep == nil || keep(index[n])) {
+				set[n] = true
+				need(n)
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range set {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		need(name)
+	}
+}
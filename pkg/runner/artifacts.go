@@ -0,0 +1,101 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+	copy "github.com/otiai10/copy"
+	"github.com/pkg/errors"
+)
+
+// ChartyDirectory is the directory in the runner directory where logs and
+// artifacts are collected
+const ChartyDirectory = ".charty"
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fileName returns a name usable as file name for the command
+func fileName(name string) string {
+	name = strings.Trim(unsafeFileChars.ReplaceAllString(name, "_"), "_.")
+	if len(name) == 0 {
+		return "unnamed"
+	}
+	return name
+}
+
+// LogFile returns the path of the log file of a command
+func LogFile(dir, name string) string {
+	return filepath.Join(dir, ChartyDirectory, "logs", fileName(name)+".log")
+}
+
+// ArtifactsDirectory returns the path where the artifacts of a command are
+// collected
+func ArtifactsDirectory(dir, name string) string {
+	return filepath.Join(dir, ChartyDirectory, "artifacts", fileName(name))
+}
+
+// OutputFile returns the path of the file where a command writes its
+// outputs, given to it as CHARTY_OUTPUT
+func OutputFile(dir, name string) string {
+	return filepath.Join(dir, ChartyDirectory, "outputs", fileName(name)+".env")
+}
+
+// openLog opens the log file of a command for appending
+func openLog(dir, name string) (*os.File, error) {
+	path := LogFile(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, errors.Wrap(err, "while creating logs directory")
+	}
+	return os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// collectArtifacts copies the files matching the patterns, relative to the
+// working directory, in the artifacts directory of the command. It returns
+// the paths of the copied artifacts.
+func collectArtifacts(dir, workdir, name string, patterns []string) ([]string, error) {
+	var err error
+	var collected []string
+	dest := ArtifactsDirectory(dir, name)
+	for _, p := range patterns {
+		matches, globErr := filepath.Glob(filepath.Join(workdir, p))
+		if globErr != nil {
+			err = multierror.Append(err, errors.Wrapf(globErr, "invalid artifact pattern '%s'", p))
+			continue
+		}
+		for _, m := range matches {
+			rel, relErr := filepath.Rel(workdir, m)
+			if relErr != nil || strings.HasPrefix(rel, ChartyDirectory) {
+				continue
+			}
+			// Artifacts are kept in the folder of the command, where
+			// files outside of the working directory would not end up
+			target := filepath.Join(dest, rel)
+			if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || !strings.HasPrefix(target, dest+string(filepath.Separator)) {
+				err = multierror.Append(err, errors.Errorf("artifact '%s' is outside of the working directory", rel))
+				continue
+			}
+			if copyErr := copy.Copy(m, target); copyErr != nil {
+				err = multierror.Append(err, errors.Wrapf(copyErr, "while collecting artifact '%s'", rel))
+				continue
+			}
+			collected = append(collected, target)
+		}
+	}
+	return collected, err
+}
@@ -14,9 +14,19 @@ limitations under the License.
 package runner
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	units "github.com/docker/go-units"
 	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -25,6 +35,98 @@ type Command struct {
 	Post string `yaml:"post"`
 	Run  string `yaml:"run"`
 	Name string `yaml:"name"`
+
+	// Hooks run after post, depending on the outcome of the command, even
+	// if it timed out or was interrupted. Always runs last.
+	OnSuccess string `yaml:"onSuccess"`
+	OnFailure string `yaml:"onFailure"`
+	Always    string `yaml:"always"`
+
+	// Shell is the interpreter with its arguments, as "bash -euo pipefail"
+	// or "python3". Script is an inline script run by it, instead of Run,
+	// and rendered with the chart values.
+	Shell  string `yaml:"shell"`
+	Script string `yaml:"script"`
+
+	// Stdin is given as input to the run process, and rendered as Script.
+	// StdinFile is a path relative to the runner directory.
+	Stdin     string `yaml:"stdin"`
+	StdinFile string `yaml:"stdinFile"`
+
+	Needs []string `yaml:"needs"`
+	// Tags label the command, to select it with Options.Tags
+	Tags []string `yaml:"tags"`
+
+	// Timeout applies to each of pre, run and post. Inactivity stops
+	// processes which didn't write any output for the given time.
+	Timeout    string `yaml:"timeout"`
+	Inactivity string `yaml:"inactivityTimeout"`
+
+	// Retries is the number of times a failed command is run again.
+	// RetryDelay is multiplied by RetryBackoff after every attempt.
+	Retries      int     `yaml:"retries"`
+	RetryDelay   string  `yaml:"retryDelay"`
+	RetryBackoff float64 `yaml:"retryBackoff"`
+
+	Expect Expect `yaml:"expect"`
+
+	// EnvFiles are dotenv files relative to the runner directory, Env
+	// takes precedence over them
+	Env      map[string]string `yaml:"env"`
+	EnvFiles []string          `yaml:"envFiles"`
+
+	// Dir is the working directory of pre, run and post, relative to the
+	// runner directory. It can't be outside of it unless AllowExternalDir
+	// is set.
+	Dir              string `yaml:"dir"`
+	AllowExternalDir bool   `yaml:"allowExternalDir"`
+
+	// If is a template expression, the command is skipped when it's
+	// false. See condition.go
+	If string `yaml:"if"`
+
+	// Matrix expands the command in a command for each combination of the
+	// values, which replace {{ .Matrix.key }} in pre, run, post, the hooks,
+	// script and stdin and are in the environment as CHARTY_MATRIX_KEY. See
+	// Commands.Expand.
+	Matrix map[string][]string `yaml:"matrix"`
+	// MatrixValues is the combination of an expanded command
+	MatrixValues map[string]string `yaml:"-"`
+
+	// Artifacts are glob patterns, relative to the working directory, of
+	// files collected after the command ran. See ArtifactsDirectory.
+	Artifacts []string `yaml:"artifacts"`
+
+	// Outputs are regular expressions matched against the output of the
+	// run phase, the first group of the first match is the value of the
+	// output. Commands can also write KEY=VALUE lines to the file in
+	// CHARTY_OUTPUT, which take precedence. Commands which need this one
+	// refer to them as {{ .Steps.name.outputs.key }} in pre, run, post,
+	// the hooks, script and stdin, or as CHARTY_STEP_NAME_KEY.
+	Outputs map[string]string `yaml:"outputs"`
+
+	// Executor is the name of the executor of pre, run and post, "local"
+	// by default, "sandbox", which uses Sandbox merged with the global
+	// sandbox options, or "ssh". See Executor.
+	Executor string          `yaml:"executor"`
+	Sandbox  SandboxExecutor `yaml:"sandbox"`
+
+	// Limits are applied to each of pre, run and post
+	Limits Limits `yaml:"limits"`
+
+	// ContinueOnError reports failures without failing the run
+	ContinueOnError bool `yaml:"continueOnError"`
+
+	// Set by the TestRunner from the global options and the chart
+	inheritedEnv, builtinEnv map[string]string
+	values                   map[string]interface{}
+	output                   OutputSink
+	executor                 Executor
+	render                   func(id, template string) (string, error)
+	// Outputs of the commands which completed before this one started
+	steps map[string]map[string]string
+	// skip is the reason the command is not run, if set
+	skip string
 }
 type Commands []Command
 
@@ -34,49 +136,434 @@ type CommandOutput struct {
 	Command                       Command
 	Testrun                       bool
 	Elapsed                       float64
+
+	Skipped    bool
+	SkipReason string
+	TimedOut   bool
+	// Interrupted is set for commands stopped as the run was cancelled
+	Interrupted bool
+	// Dir is the directory the command ran in
+	Dir string
+	// LogFile has the output of all the attempts of the command, Artifacts
+	// are the paths of the collected artifacts
+	LogFile   string
+	Artifacts []string
+	// Outputs published by the command
+	Outputs map[string]string
+
+	// Pre, Run, Post and the hooks are nil for the phases which didn't run.
+	// ExitCode and Signal are the ones of the run phase, ExitCode is -1 if
+	// it didn't exit on its own.
+	Pre, Run, Post               *PhaseOutput
+	OnSuccess, OnFailure, Always *PhaseOutput
+	ExitCode                     int
+	Signal                       string
+	// Start and End delimit the attempt, Usage is the one of all its
+	// phases
+	Start, End time.Time
+	Usage      Usage
+	// FailedPhase is the first of setup, pre, run, post, onSuccess,
+	// onFailure, always, outputs and artifacts which failed
+	FailedPhase string
+
+	// Attempts holds the output of every attempt, the last one included
+	Attempts []CommandOutput
+
+	// ShuffleSeed is the seed the order of the commands was shuffled with,
+	// 0 if it wasn't
+	ShuffleSeed int64
+}
+
+// Failed reports whether the command failed the run.
+func (r CommandOutput) Failed() bool {
+	return r.Error != nil && !r.Command.ContinueOnError
+}
+
+// Flaky reports whether the command passed only after being retried.
+func (r CommandOutput) Flaky() bool {
+	return r.Error == nil && len(r.Attempts) > 1
+}
+
+func (c Command) Start(ctx context.Context, dir string) CommandOutput {
+	var attempts []CommandOutput
+
+	// Durations are checked by Validate
+	delay, _ := parseDuration(c.RetryDelay)
+	for i := 0; ; i++ {
+		out := c.attempt(ctx, dir)
+		attempts = append(attempts, out)
+		if out.Error == nil || i >= c.Retries || ctx.Err() != nil {
+			out.Attempts = attempts
+			return out
+		}
+
+		log.WithFields(log.Fields{
+			"name":    c.Name,
+			"command": c.Run,
+			"attempt": i + 1,
+		}).Warn("Failed, retrying in " + delay.String() + ": " + out.Error.Error())
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		// No attempt starts once the run is cancelled
+		if ctx.Err() != nil {
+			out.Interrupted = true
+			out.Attempts = attempts
+			return out
+		}
+		delay = backoff(delay, c.RetryBackoff)
+	}
 }
 
-func (c Command) Start(dir string) CommandOutput {
+func (c Command) attempt(ctx context.Context, dir string) CommandOutput {
 	var err error
-	var preoutput, postoutput string
 	var res error
+	var timedOut, interrupted bool
 
 	log.WithFields(log.Fields{
 		"name":    c.Name,
 		"command": c.Run,
 	}).Info("Starting")
 
+	begin := time.Now()
+	failed := ""
+	fail := func(phase string) {
+		if failed == "" {
+			failed = phase
+		}
+	}
+	setupError := func(err error, workdir string) CommandOutput {
+		return CommandOutput{
+			Command:     c,
+			Error:       err,
+			Testrun:     true,
+			Dir:         workdir,
+			ExitCode:    -1,
+			Start:       begin,
+			End:         time.Now(),
+			FailedPhase: "setup",
+		}
+	}
+
+	// Durations are checked by Validate
+	timeout, _ := parseDuration(c.Timeout)
+	inactivity, _ := parseDuration(c.Inactivity)
+
+	c, err = c.withSteps()
+	if err != nil {
+		return setupError(err, "")
+	}
+
+	workdir, err := c.workingDirectory(dir)
+	if err != nil {
+		return setupError(err, "")
+	}
+
+	fileEnv, err := loadEnvFiles(dir, c.EnvFiles)
+	if err != nil {
+		return setupError(err, workdir)
+	}
+	outputFile := OutputFile(dir, c.Name)
+	if err := resetOutputFile(outputFile); err != nil {
+		return setupError(err, workdir)
+	}
+	env := environ(mergeEnv(c.inheritedEnv, fileEnv, c.Env, c.builtinEnv, matrixEnv(c.MatrixValues), stepsEnv(c.steps), map[string]string{
+		"CHARTY_COMMAND_NAME": c.Name,
+		"CHARTY_RUNNER_DIR":   dir,
+		"CHARTY_OUTPUT":       outputFile,
+	}))
+
+	sink := c.output
+	if sink == nil {
+		sink = StdSink
+	}
+	stdout, stderr := sink.Stdout(c), sink.Stderr(c)
+
+	logFile, logErr := openLog(dir, c.Name)
+	if logErr != nil {
+		log.WithField("name", c.Name).Warn("Can't write the command log: " + logErr.Error())
+	} else {
+		defer logFile.Close()
+	}
+
+	runCmd, runFile := c.Run, false
+	if len(c.Script) > 0 {
+		runCmd, err = c.writeScript(dir)
+		if err != nil {
+			return setupError(err, workdir)
+		}
+		runFile = true
+	}
+
+	stdin, err := c.stdin(dir)
+	if err != nil {
+		return setupError(err, workdir)
+	}
+
+	var executor Executor = LocalExecutor{}
+	if c.executor != nil {
+		executor = c.executor
+	}
+	run := func(phase, cmd string, file bool, input io.Reader) (PhaseOutput, error) {
+		var logWriter io.Writer
+		if logFile != nil {
+			fmt.Fprintf(logFile, "==> %s %s: %s\n", time.Now().Format(time.RFC3339), phase, cmd)
+			logWriter = logFile
+		}
+		pctx := ctx
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			pctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		out, err := executor.Run(pctx, Process{
+			Shell:      strings.Fields(c.Shell),
+			File:       file,
+			Stdin:      input,
+			Command:    cmd,
+			Dir:        workdir,
+			RunnerDir:  dir,
+			Inactivity: inactivity,
+			Limits:     c.Limits,
+			Env:        env,
+			Stdout:     stdout,
+			Stderr:     stderr,
+			Log:        logWriter,
+		})
+		if isTimeout(err) {
+			timedOut = true
+		}
+		if isInterrupted(err) {
+			interrupted = true
+		}
+		return out, err
+	}
+
+	var pre, post, onSuccess, onFailure, always *PhaseOutput
 	if len(c.Pre) > 0 {
-		preoutput, res = runProc(c.Pre, dir)
+		out, res := run("pre", c.Pre, false, nil)
+		pre = &out
 		if res != nil {
 			err = multierror.Append(err, res)
+			fail("pre")
 		}
 	}
-	start := time.Now()
-	run, res := runProc(c.Run, dir)
-	if res != nil {
-		err = multierror.Append(err, res)
+	// Nothing is run after a failed pre, besides post and the hooks
+	out := PhaseOutput{Command: runCmd, ExitCode: -1}
+	if err == nil {
+		out, res = run("run", runCmd, runFile, stdin)
+		if !isTimeout(res) && !isInterrupted(res) {
+			res = c.Expect.check(out, res)
+			out.Error = res
+		}
+		if res != nil {
+			err = multierror.Append(err, res)
+			fail("run")
+		}
 	}
-	delta := time.Since(start)
 	if len(c.Post) > 0 {
-		postoutput, res = runProc(c.Post, dir)
+		out, res := run("post", c.Post, false, nil)
+		post = &out
 		if res != nil {
 			err = multierror.Append(err, res)
+			fail("post")
 		}
 	}
 
-	return CommandOutput{
-		PreOutput:  preoutput,
-		PostOutput: postoutput,
-		Output:     run,
-		Error:      err,
-		Command:    c,
-		Elapsed:    delta.Seconds(),
-		Testrun:    true,
+	// Hooks run even if the run timed out or was interrupted
+	if ctx.Err() != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), DefaultPostTimeout)
+		defer cancel()
 	}
+	hook := func(phase, cmd string) *PhaseOutput {
+		out, res := run(phase, cmd, false, nil)
+		if res != nil {
+			err = multierror.Append(err, res)
+			fail(phase)
+		}
+		return &out
+	}
+	if len(c.OnSuccess) > 0 && err == nil {
+		onSuccess = hook("onSuccess", c.OnSuccess)
+	} else if len(c.OnFailure) > 0 && err != nil {
+		onFailure = hook("onFailure", c.OnFailure)
+	}
+	if len(c.Always) > 0 {
+		always = hook("always", c.Always)
+	}
+
+	fileOutputs, res := readOutputFile(outputFile)
+	if res != nil {
+		err = multierror.Append(err, res)
+		fail("outputs")
+	}
+	outputs := mergeEnv(c.captureOutputs(out.Stdout), fileOutputs)
+
+	artifacts, res := collectArtifacts(dir, workdir, c.Name, c.Artifacts)
+	if res != nil {
+		err = multierror.Append(err, res)
+		fail("artifacts")
+	}
+
+	result := CommandOutput{
+		Output:      out.Output,
+		Error:       err,
+		Command:     c,
+		Elapsed:     out.End.Sub(out.Start).Seconds(),
+		Testrun:     true,
+		TimedOut:    timedOut,
+		Interrupted: interrupted,
+		Dir:         workdir,
+		LogFile:     LogFile(dir, c.Name),
+		Artifacts:   artifacts,
+		Outputs:     outputs,
+		Pre:         pre,
+		Post:        post,
+		OnSuccess:   onSuccess,
+		OnFailure:   onFailure,
+		Always:      always,
+		ExitCode:    out.ExitCode,
+		Signal:      out.Signal,
+		Start:       begin,
+		End:         time.Now(),
+		FailedPhase: failed,
+	}
+	if !out.Start.IsZero() {
+		result.Run = &out
+	} else {
+		result.Elapsed = 0
+	}
+	if pre != nil {
+		result.PreOutput = pre.Output
+	}
+	if post != nil {
+		result.PostOutput = post.Output
+	}
+	for _, p := range []*PhaseOutput{pre, result.Run, post, onSuccess, onFailure, always} {
+		if p != nil {
+			result.Usage = result.Usage.Add(p.Usage)
+		}
+	}
+	return result
+}
+
+// writeScript renders the inline script of the command in the runner
+// directory, and returns its path.
+func (c Command) writeScript(dir string) (string, error) {
+	script := c.Script
+	if c.render != nil {
+		var err error
+		script, err = c.render(fileName(c.Name), c.Script)
+		if err != nil {
+			return "", errors.Wrap(err, "while rendering script")
+		}
+	}
+
+	path := filepath.Join(dir, ChartyDirectory, "scripts", fileName(c.Name)+scriptExtension(c.Shell))
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return "", errors.Wrap(err, "while creating scripts directory")
+	}
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		return "", errors.Wrap(err, "while writing script")
+	}
+	return path, nil
+}
+
+// scriptExtensions are the extensions of the scripts, for the shells
+// which only run files having them
+var scriptExtensions = map[string]string{
+	"pwsh":       ".ps1",
+	"powershell": ".ps1",
+}
+
+// scriptExtension returns the extension of the scripts run by the shell
+func scriptExtension(shell string) string {
+	fields := strings.Fields(shell)
+	if len(fields) == 0 {
+		return ""
+	}
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(fields[0]), ".exe"))
+	return scriptExtensions[name]
+}
+
+// resolvePath returns the path relative to the runner directory, which
+// must be inside of it unless allowExternal is set.
+func resolvePath(dir, path string, allowExternal bool) (string, error) {
+	res := path
+	if !filepath.IsAbs(res) {
+		res = filepath.Join(dir, res)
+	}
+	if allowExternal {
+		return res, nil
+	}
+
+	// Resolve symlinks, so they can't be used to escape the runner directory
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return res, errors.Wrap(err, "while resolving runner directory")
+	}
+	resolved, err := filepath.EvalSymlinks(res)
+	if err != nil {
+		return res, errors.Wrapf(err, "while resolving '%s'", path)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return res, errors.Errorf("'%s' is outside of the runner directory", path)
+	}
+	return res, nil
+}
+
+// workingDirectory returns the directory where the command runs, given
+// the runner directory.
+func (c Command) workingDirectory(dir string) (string, error) {
+	if len(c.Dir) == 0 {
+		return dir, nil
+	}
+
+	workdir, err := resolvePath(dir, c.Dir, c.AllowExternalDir)
+	return workdir, errors.Wrap(err, "invalid working directory")
+}
+
+// stdin returns the input of the run process, the inline one is rendered
+// with the chart values.
+func (c Command) stdin(dir string) (io.Reader, error) {
+	if len(c.StdinFile) > 0 {
+		path, err := resolvePath(dir, c.StdinFile, false)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid stdin file")
+		}
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading stdin file")
+		}
+		return bytes.NewReader(dat), nil
+	}
+
+	if len(c.Stdin) == 0 {
+		return nil, nil
+	}
+	stdin := c.Stdin
+	if c.render != nil {
+		var err error
+		stdin, err = c.render(fileName(c.Name)+"-stdin", c.Stdin)
+		if err != nil {
+			return nil, errors.Wrap(err, "while rendering stdin")
+		}
+	}
+	return strings.NewReader(stdin), nil
 }
 
 func (r CommandOutput) Log() {
+	if r.Skipped {
+		log.WithFields(log.Fields{
+			"name":    r.Command.Name,
+			"command": r.Command.Run,
+		}).Warn("Not run: " + r.SkipReason)
+		return
+	}
+
 	if len(r.PreOutput) > 0 {
 		log.WithFields(log.Fields{
 			"name":    r.Command.Name,
@@ -93,30 +580,65 @@ func (r CommandOutput) Log() {
 		}).Info(r.PostOutput)
 	}
 
+	for i, hook := range []*PhaseOutput{r.OnSuccess, r.OnFailure, r.Always} {
+		if hook != nil && len(hook.Output) > 0 {
+			log.WithFields(log.Fields{
+				"name":    r.Command.Name,
+				"command": hook.Command,
+				"hook":    []string{"onSuccess", "onFailure", "always"}[i],
+				"success": hook.Error == nil,
+			}).Info(hook.Output)
+		}
+	}
+
+	if len(r.Outputs) > 0 {
+		log.WithFields(log.Fields{
+			"name":    r.Command.Name,
+			"outputs": r.Outputs,
+		}).Info("Outputs")
+	}
+
 	if r.Error != nil {
 		log.WithFields(log.Fields{
-			"name":       r.Command.Name,
-			"command":    r.Command.Run,
-			"success":    r.Error == nil,
-			"elapsed(s)": r.Elapsed,
+			"name":        r.Command.Name,
+			"command":     r.Command.Run,
+			"success":     r.Error == nil,
+			"timed_out":   r.TimedOut,
+			"interrupted": r.Interrupted,
+			"attempts":    len(r.Attempts),
+			"elapsed(s)":  r.Elapsed,
+			"cpu_time(s)": r.Usage.CPUTime().Seconds(),
+			"max_rss":     units.BytesSize(float64(r.Usage.MaxRSS)),
 		}).Error(r.Output + "\n error: \n" + r.Error.Error())
 	} else {
 		log.WithFields(log.Fields{
-			"name":       r.Command.Name,
-			"command":    r.Command.Run,
-			"success":    r.Error == nil,
-			"elapsed(s)": r.Elapsed,
+			"name":        r.Command.Name,
+			"command":     r.Command.Run,
+			"success":     r.Error == nil,
+			"attempts":    len(r.Attempts),
+			"elapsed(s)":  r.Elapsed,
+			"cpu_time(s)": r.Usage.CPUTime().Seconds(),
+			"max_rss":     units.BytesSize(float64(r.Usage.MaxRSS)),
 		}).Info(r.Output)
 	}
 }
 
-func (l Commands) Start(dir string) []CommandOutput {
-	var res []CommandOutput
-
-	for _, t := range l {
-		run := t.Start(dir)
-		res = append(res, run)
-		run.Log()
+// Start runs the commands in the given directory. Commands run
+// concurrently, up to parallel at a time, as soon as the commands they need
+// have succeeded.
+func (l Commands) Start(ctx context.Context, dir string, parallel int) ([]CommandOutput, error) {
+	l, err := l.Expand()
+	if err != nil {
+		return []CommandOutput{}, err
 	}
-	return res
+	if err := l.Validate(); err != nil {
+		return []CommandOutput{}, err
+	}
+
+	return l.schedule(ctx, scheduleOptions{
+		Parallel: parallel,
+		Start: func(ctx context.Context, c Command) CommandOutput {
+			return c.Start(ctx, dir)
+		},
+	}), nil
 }
@@ -0,0 +1,114 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Allows calling the functions as `failed("deploy")`, besides the template
+// syntax `failed "deploy"`
+var conditionCall = regexp.MustCompile(`\b(succeeded|failed|skipped)\(`)
+
+// Matches the names given to the functions, as `failed("deploy")` or
+// `failed "deploy"`
+var conditionArgument = regexp.MustCompile(`\b(?:succeeded|failed|skipped)\s*\(?\s*"([^"]*)"`)
+
+// conditionData is what `if` expressions are evaluated against
+type conditionData struct {
+	Values map[string]interface{}
+	Env    map[string]string
+	Matrix map[string]string
+}
+
+// conditionTemplate wraps the `if` expression of the command in a
+// template. The functions are looking up the results of the completed
+// commands, by name.
+func (c Command) conditionTemplate(results map[string]CommandOutput) (*template.Template, error) {
+	lookup := func(name string) (CommandOutput, bool) {
+		r, ok := results[name]
+		return r, ok
+	}
+	funcs := template.FuncMap{
+		"succeeded": func(name string) bool {
+			r, ok := lookup(name)
+			return ok && !r.Skipped && r.Error == nil
+		},
+		"failed": func(name string) bool {
+			r, ok := lookup(name)
+			return ok && !r.Skipped && r.Error != nil
+		},
+		"skipped": func(name string) bool {
+			r, ok := lookup(name)
+			return ok && r.Skipped
+		},
+	}
+
+	expr := conditionCall.ReplaceAllString(c.If, "($1 ")
+	return template.New(c.Name).Funcs(funcs).Parse("{{ if " + expr + " }}true{{ end }}")
+}
+
+// checked returns the names of the commands whose result the `if`
+// expression of the command looks at.
+func (c Command) checked() []string {
+	var res []string
+	for _, m := range conditionArgument.FindAllStringSubmatch(c.If, -1) {
+		res = append(res, m[1])
+	}
+	return res
+}
+
+// checks reports whether the `if` expression of the command looks at the
+// result of the named command. Commands needing it run even if it failed
+// or was not run, and leave the decision to the condition.
+func (c Command) checks(name string) bool {
+	for _, n := range c.checked() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// condition evaluates the `if` expression of the command, given the
+// results of the commands which completed.
+func (c Command) condition(results map[string]CommandOutput) (bool, error) {
+	if len(c.If) == 0 {
+		return true, nil
+	}
+
+	t, err := c.conditionTemplate(results)
+	if err != nil {
+		return false, err
+	}
+
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		if pair := strings.SplitN(kv, "=", 2); len(pair) == 2 {
+			env[pair[0]] = pair[1]
+		}
+	}
+
+	var out bytes.Buffer
+	err = t.Execute(&out, conditionData{
+		Values: c.values,
+		Env:    mergeEnv(env, c.inheritedEnv, c.Env, c.builtinEnv, matrixEnv(c.MatrixValues)),
+		Matrix: c.MatrixValues,
+	})
+	return out.String() == "true", err
+}
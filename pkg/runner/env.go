@@ -0,0 +1,103 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseEnv parses KEY=VALUE pairs, as given from the cli.
+func ParseEnv(pairs []string) (map[string]string, error) {
+	env := map[string]string{}
+	for _, p := range pairs {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return env, errors.Errorf("invalid environment variable '%s', expected KEY=VALUE", p)
+		}
+		env[kv[0]] = kv[1]
+	}
+	return env, nil
+}
+
+// parseDotEnv parses the content of a dotenv file. Empty lines and
+// comments are skipped, an `export` prefix and quotes around values are
+// allowed.
+func parseDotEnv(dat string) (map[string]string, error) {
+	env := map[string]string{}
+	for i, l := range strings.Split(dat, "\n") {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+		l = strings.TrimPrefix(l, "export ")
+
+		kv := strings.SplitN(l, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || len(key) == 0 {
+			return env, errors.Errorf("line %d: expected KEY=VALUE", i+1)
+		}
+
+		value := strings.TrimSpace(kv[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[key] = value
+	}
+	return env, nil
+}
+
+// loadEnvFiles reads the dotenv files, relative to dir. Variables in the
+// later files take precedence.
+func loadEnvFiles(dir string, files []string) (map[string]string, error) {
+	env := map[string]string{}
+	for _, f := range files {
+		dat, err := ioutil.ReadFile(filepath.Join(dir, f))
+		if err != nil {
+			return env, errors.Wrap(err, "while reading env file")
+		}
+		vars, err := parseDotEnv(string(dat))
+		if err != nil {
+			return env, errors.Wrapf(err, "while parsing env file '%s'", f)
+		}
+		env = mergeEnv(env, vars)
+	}
+	return env, nil
+}
+
+// mergeEnv returns a new map with the variables of all the given maps,
+// the later ones take precedence.
+func mergeEnv(envs ...map[string]string) map[string]string {
+	res := map[string]string{}
+	for _, e := range envs {
+		for k, v := range e {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// environ returns the variables in the KEY=VALUE form, sorted by name.
+func environ(env map[string]string) []string {
+	res := []string{}
+	for k, v := range env {
+		res = append(res, k+"="+v)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,60 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Executor runs the processes of the commands. The output is streamed to
+// the writers of the process as it is written, and the process is stopped
+// when the context is done.
+type Executor interface {
+	Run(ctx context.Context, p Process) (PhaseOutput, error)
+}
+
+// LocalExecutor runs processes on the host, it's the default executor.
+type LocalExecutor struct{}
+
+func (LocalExecutor) Run(ctx context.Context, p Process) (PhaseOutput, error) {
+	return runProc(ctx, p, nil)
+}
+
+// executor returns the executor of a command by name, "local", "sandbox"
+// and "ssh" are built in and the others are looked up in
+// TestRunner.Executors. sandbox are the global sandbox options, and remote
+// is shared by the commands run on the host.
+func (t *TestRunner) executor(c Command, sandbox SandboxExecutor, remote *SSHExecutor) (Executor, error) {
+	if e, ok := t.Executors[c.Executor]; ok {
+		return e, nil
+	}
+	switch c.Executor {
+	case "", "local":
+		return LocalExecutor{}, nil
+	case "sandbox":
+		s := sandbox.merge(c.Sandbox)
+		if err := s.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid sandbox for command '%s'", c.Name)
+		}
+		return s, nil
+	case "ssh":
+		if err := remote.Options.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid ssh options for command '%s'", c.Name)
+		}
+		return remote, nil
+	}
+	return nil, errors.Errorf("unknown executor '%s' for command '%s'", c.Executor, c.Name)
+}
@@ -0,0 +1,150 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"regexp"
+	"strings"
+
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
+)
+
+// excerptLines is the number of output lines shown when an assertion fails
+const excerptLines = 10
+
+// Expect describes the checks made on the `run` process of a command.
+// Without any of them, a command succeeds when it exits with 0.
+type Expect struct {
+	// ExitCodes are the exit codes considered successful
+	ExitCodes []int `yaml:"exitCodes"`
+	Stdout    Match `yaml:"stdout"`
+	Stderr    Match `yaml:"stderr"`
+	// FailOn are regexes which fail the command if they match the output,
+	// whatever the exit code is
+	FailOn []string `yaml:"failOn"`
+}
+
+// Match holds checks on a stream of output. Matches and NotMatches are
+// regular expressions, where ^ and $ match at line boundaries.
+type Match struct {
+	Contains    []string `yaml:"contains"`
+	NotContains []string `yaml:"notContains"`
+	Matches     []string `yaml:"matches"`
+	NotMatches  []string `yaml:"notMatches"`
+}
+
+// Validate checks that the regular expressions compile.
+func (e Expect) Validate() error {
+	for _, m := range []Match{e.Stdout, e.Stderr} {
+		for _, r := range append(append([]string{}, m.Matches...), m.NotMatches...) {
+			if _, err := compile(r); err != nil {
+				return err
+			}
+		}
+	}
+	for _, r := range e.FailOn {
+		if _, err := compile(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compile(r string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?m)" + r)
+}
+
+func mustCompile(r string) *regexp.Regexp {
+	return regexp.MustCompile("(?m)" + r)
+}
+
+// excerpt returns the last lines of the output.
+func excerpt(s string) string {
+	lines := strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	if len(lines) > excerptLines {
+		lines = append([]string{"[...]"}, lines[len(lines)-excerptLines:]...)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// matchingLine returns the first line of the output matching the regex.
+func matchingLine(s string, r *regexp.Regexp) string {
+	for _, l := range strings.Split(s, "\n") {
+		if r.MatchString(l) {
+			return l
+		}
+	}
+	return r.FindString(s)
+}
+
+func (m Match) check(stream, output string) error {
+	var err error
+
+	for _, c := range m.Contains {
+		if !strings.Contains(output, c) {
+			err = multierror.Append(err, errors.Errorf("%s does not contain '%s':\n%s", stream, c, excerpt(output)))
+		}
+	}
+	for _, c := range m.NotContains {
+		if strings.Contains(output, c) {
+			err = multierror.Append(err, errors.Errorf("%s contains '%s':\n%s", stream, c, matchingLine(output, regexp.MustCompile(regexp.QuoteMeta(c)))))
+		}
+	}
+	for _, r := range m.Matches {
+		if !mustCompile(r).MatchString(output) {
+			err = multierror.Append(err, errors.Errorf("%s does not match '%s':\n%s", stream, r, excerpt(output)))
+		}
+	}
+	for _, r := range m.NotMatches {
+		if re := mustCompile(r); re.MatchString(output) {
+			err = multierror.Append(err, errors.Errorf("%s matches '%s':\n%s", stream, r, matchingLine(output, re)))
+		}
+	}
+	return err
+}
+
+// check returns the error for a process output, given the error it exited
+// with. Regexes are checked by Validate.
+func (e Expect) check(out PhaseOutput, procErr error) error {
+	var err error
+
+	if len(e.ExitCodes) == 0 {
+		err = procErr
+	} else {
+		expected := false
+		for _, c := range e.ExitCodes {
+			if c == out.ExitCode {
+				expected = true
+			}
+		}
+		if !expected {
+			err = multierror.Append(err, errors.Errorf("exit code %d, expected one of %v:\n%s", out.ExitCode, e.ExitCodes, excerpt(out.Output)))
+		}
+	}
+
+	if res := e.Stdout.check("stdout", out.Stdout); res != nil {
+		err = multierror.Append(err, res)
+	}
+	if res := e.Stderr.check("stderr", out.Stderr); res != nil {
+		err = multierror.Append(err, res)
+	}
+	for _, r := range e.FailOn {
+		if re := mustCompile(r); re.MatchString(out.Output) {
+			err = multierror.Append(err, errors.Errorf("output matches '%s':\n%s", r, matchingLine(out.Output, re)))
+		}
+	}
+
+	return err
+}
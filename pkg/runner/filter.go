@@ -0,0 +1,127 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// hasTag reports whether the command has the tag
+func (c Command) hasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// matchTags returns the first of the tag expressions the command matches.
+// Expressions are tags joined by `+`, which must all match, and a tag
+// starting with `!` matches the commands not having it.
+func (c Command) matchTags(exprs []string) (string, bool) {
+	for _, e := range exprs {
+		matches := true
+		for _, t := range strings.Split(e, "+") {
+			t = strings.TrimSpace(t)
+			if strings.HasPrefix(t, "!") == c.hasTag(strings.TrimPrefix(t, "!")) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return e, true
+		}
+	}
+	return "", false
+}
+
+// validateTags checks that the tag expressions have no empty tags
+func validateTags(exprs []string) error {
+	for _, e := range exprs {
+		for _, t := range strings.Split(e, "+") {
+			if len(strings.TrimPrefix(strings.TrimSpace(t), "!")) == 0 {
+				return errors.Errorf("invalid tag expression '%s'", e)
+			}
+		}
+	}
+	return nil
+}
+
+// filter marks the commands which are not selected by the filters of the
+// options as skipped. The commands needed by the selected ones are kept,
+// unless they are excluded by Skip or ExcludeTags.
+func (o Options) filter(l Commands) error {
+	if len(o.Focus) == 0 && len(o.Skip) == 0 && len(o.Tags) == 0 && len(o.ExcludeTags) == 0 {
+		return nil
+	}
+	var focus, skip *regexp.Regexp
+	var err error
+	if len(o.Focus) > 0 {
+		if focus, err = regexp.Compile(o.Focus); err != nil {
+			return errors.Wrap(err, "invalid focus")
+		}
+	}
+	if len(o.Skip) > 0 {
+		if skip, err = regexp.Compile(o.Skip); err != nil {
+			return errors.Wrap(err, "invalid skip")
+		}
+	}
+	if err := validateTags(o.Tags); err != nil {
+		return errors.Wrap(err, "invalid tags")
+	}
+	if err := validateTags(o.ExcludeTags); err != nil {
+		return errors.Wrap(err, "invalid excluded tags")
+	}
+
+	excluded := func(c Command) string {
+		if skip != nil && skip.MatchString(c.Name) {
+			return "matches skip '" + o.Skip + "'"
+		}
+		if t, ok := c.matchTags(o.ExcludeTags); ok {
+			return "matches excluded tags '" + t + "'"
+		}
+		return ""
+	}
+
+	selected := map[string]bool{}
+	reasons := map[string]string{}
+	for _, c := range l {
+		reason := excluded(c)
+		if len(reason) == 0 && focus != nil && !focus.MatchString(c.Name) {
+			reason = "doesn't match focus '" + o.Focus + "'"
+		}
+		if _, ok := c.matchTags(o.Tags); len(reason) == 0 && len(o.Tags) > 0 && !ok {
+			reason = "matches none of the tags '" + strings.Join(o.Tags, "', '") + "'"
+		}
+		if len(reason) > 0 {
+			reasons[c.Name] = reason
+		} else {
+			selected[c.Name] = true
+		}
+	}
+
+	l.withNeeds(selected, func(c Command) bool {
+		return len(excluded(c)) == 0
+	})
+	for i, c := range l {
+		if !selected[c.Name] && len(c.skip) == 0 {
+			l[i].skip = "filtered out (" + reasons[c.Name] + ")"
+		}
+	}
+	return nil
+}
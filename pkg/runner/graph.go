@@ -0,0 +1,277 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	statePending = iota
+	stateRunning
+	stateSucceeded
+	stateFailed
+	stateSkipped
+)
+
+// Validate checks that command names are unique, that every command
+// listed in `needs` exists, that the dependency graph has no cycles and
+// that the commands settings are valid.
+func (l Commands) Validate() error {
+	index := map[string]int{}
+	for i, c := range l {
+		if len(c.Script) > 0 && len(c.Run) > 0 {
+			return errors.Errorf("command '%s' has both run and script", c.Name)
+		}
+		if len(c.Stdin) > 0 && len(c.StdinFile) > 0 {
+			return errors.Errorf("command '%s' has both stdin and stdinFile", c.Name)
+		}
+		if _, err := parseDuration(c.Timeout); err != nil {
+			return errors.Wrapf(err, "invalid timeout for command '%s'", c.Name)
+		}
+		if _, err := parseDuration(c.Inactivity); err != nil {
+			return errors.Wrapf(err, "invalid inactivity timeout for command '%s'", c.Name)
+		}
+		if _, err := parseDuration(c.RetryDelay); err != nil {
+			return errors.Wrapf(err, "invalid retry delay for command '%s'", c.Name)
+		}
+		if len(c.If) > 0 {
+			if _, err := c.conditionTemplate(nil); err != nil {
+				return errors.Wrapf(err, "invalid condition for command '%s'", c.Name)
+			}
+			// Conditions are evaluated once the needs completed, the
+			// results of other commands might not be there yet
+		checked:
+			for _, n := range c.checked() {
+				for _, need := range c.Needs {
+					if need == n {
+						continue checked
+					}
+				}
+				return errors.Errorf("condition of command '%s' looks at '%s', which is not in its needs", c.Name, n)
+			}
+		}
+		if err := c.Expect.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid expect for command '%s'", c.Name)
+		}
+		if err := c.Limits.Validate(); err != nil {
+			return errors.Wrapf(err, "invalid limits for command '%s'", c.Name)
+		}
+		if err := c.validateOutputs(); err != nil {
+			return errors.Wrapf(err, "invalid outputs for command '%s'", c.Name)
+		}
+		// Results, logs and outputs are named after the commands
+		if _, ok := index[c.Name]; ok {
+			return errors.Errorf("command '%s' is defined more than once", c.Name)
+		}
+		index[c.Name] = i
+	}
+
+	for _, c := range l {
+		for _, n := range c.Needs {
+			if _, ok := index[n]; !ok {
+				return errors.Errorf("command '%s' needs unknown command '%s'", c.Name, n)
+			}
+		}
+	}
+
+	// Depth-first visit, keeping track of the current path to report cycles
+	visited := make([]int, len(l))
+	var path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch visited[i] {
+		case 1:
+			return errors.Errorf("dependency cycle detected: %s -> %s", strings.Join(path, " -> "), l[i].Name)
+		case 2:
+			return nil
+		}
+		visited[i] = 1
+		path = append(path, l[i].Name)
+		for _, n := range l[i].Needs {
+			if err := visit(index[n]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		visited[i] = 2
+		return nil
+	}
+
+	for i := range l {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type scheduledOutput struct {
+	index  int
+	output CommandOutput
+}
+
+type scheduleOptions struct {
+	// Parallel is the maximum number of commands running at the same time
+	Parallel int
+	// FailFast stops the running commands and doesn't start new ones
+	// after the first failure
+	FailFast bool
+	Start    func(context.Context, Command) CommandOutput
+}
+
+// shuffle randomises the order of the commands, which is the order they
+// are started in when they don't need each other.
+func (l Commands) shuffle(seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(l), func(i, j int) {
+		l[i], l[j] = l[j], l[i]
+	})
+}
+
+// schedule runs the commands honoring their dependencies. Results are
+// returned in the same order of the commands list, which is the shuffled
+// one when the commands were shuffled.
+func (l Commands) schedule(ctx context.Context, o scheduleOptions) []CommandOutput {
+	parallel := o.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	stopped := ""
+	// The context of the commands, cancelled when fail fast stops the run
+	run, stop := context.WithCancel(ctx)
+	defer stop()
+
+	index := map[string]int{}
+	for i, c := range l {
+		index[c.Name] = i
+	}
+
+	res := make([]CommandOutput, len(l))
+	// Outputs of the completed commands, by name
+	results := map[string]CommandOutput{}
+	state := make([]int, len(l))
+	finished := make(chan scheduledOutput)
+	running, remaining := 0, len(l)
+
+	// complete records the result of a command, the first failure stops
+	// the run with fail fast
+	complete := func(i int, out CommandOutput) {
+		remaining--
+		res[i] = out
+		results[l[i].Name] = out
+		if out.Error != nil {
+			state[i] = stateFailed
+			if o.FailFast && out.Failed() && len(stopped) == 0 {
+				stopped = l[i].Name
+				stop()
+			}
+		} else {
+			state[i] = stateSucceeded
+		}
+		out.Log()
+	}
+
+	for remaining > 0 {
+		for changed := true; changed; {
+			changed = false
+			for i, c := range l {
+				if state[i] != statePending {
+					continue
+				}
+
+				// Commands with a condition wait for what they need to
+				// complete, and let the condition decide if they run
+				ready, reason := true, ""
+				for _, n := range c.Needs {
+					switch state[index[n]] {
+					case stateSucceeded:
+					case stateFailed:
+						if !c.checks(n) {
+							reason = "needed command '" + n + "' failed"
+						}
+					case stateSkipped:
+						if !c.checks(n) {
+							reason = "needed command '" + n + "' was not run"
+						}
+					default:
+						ready = false
+					}
+					if len(reason) > 0 {
+						break
+					}
+				}
+
+				if len(c.skip) > 0 {
+					reason = c.skip
+				} else if ctx.Err() == context.DeadlineExceeded {
+					reason = "run timed out"
+				} else if ctx.Err() != nil {
+					reason = "run interrupted"
+				} else if len(stopped) > 0 {
+					reason = "run stopped after '" + stopped + "' failed"
+				}
+
+				if len(reason) == 0 && ready && running < parallel && len(c.If) > 0 {
+					ok, err := c.condition(results)
+					if err != nil {
+						complete(i, CommandOutput{Command: c, Error: errors.Wrap(err, "while evaluating condition"), Testrun: true})
+						changed = true
+						continue
+					}
+					if !ok {
+						reason = "condition '" + c.If + "' is false"
+					}
+				}
+
+				if len(reason) > 0 {
+					res[i] = CommandOutput{Command: c, Skipped: true, SkipReason: reason}
+					res[i].Log()
+					results[c.Name] = res[i]
+					state[i] = stateSkipped
+					remaining--
+					changed = true
+					continue
+				}
+
+				if !ready || running >= parallel {
+					continue
+				}
+
+				state[i] = stateRunning
+				running++
+				c.steps = steps(c.steps, results)
+				go func(i int, c Command) {
+					finished <- scheduledOutput{index: i, output: o.Start(run, c)}
+				}(i, c)
+			}
+		}
+
+		if running == 0 {
+			// Nothing left that can be started, this can't happen on a
+			// validated list
+			break
+		}
+
+		r := <-finished
+		running--
+		complete(r.index, r.output)
+	}
+
+	return res
+}
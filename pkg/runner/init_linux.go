@@ -0,0 +1,99 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// initName is the name the current executable is started with to set up
+// the sandbox and the limits of a process, before executing its command
+const initName = "charty-init"
+
+// processInit is what is set up before executing the command
+type processInit struct {
+	Sandbox *sandbox `json:",omitempty"`
+	Limits  Limits
+}
+
+func init() {
+	if len(os.Args) < 3 || os.Args[0] != initName {
+		return
+	}
+	if err := initMain(os.Args[1], os.Args[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, "charty init: "+err.Error())
+		os.Exit(125)
+	}
+}
+
+// reexec makes the command start the current executable, which sets up
+// the process as described and executes the original command. update is
+// called with the current description, for commands which were already
+// changed.
+func reexec(cmd *exec.Cmd, update func(*processInit)) error {
+	var i processInit
+	args := cmd.Args
+	if len(args) > 2 && args[0] == initName {
+		if err := json.Unmarshal([]byte(args[1]), &i); err != nil {
+			return err
+		}
+		args = args[2:]
+	} else {
+		args = append([]string{cmd.Path}, args...)
+	}
+	update(&i)
+
+	config, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	cmd.Path = "/proc/self/exe"
+	cmd.Args = append([]string{initName, string(config)}, args...)
+	return nil
+}
+
+// initMain sets up the process and executes the command, args are its
+// path and arguments.
+func initMain(config string, args []string) error {
+	// Credentials are per thread, and set up on the one which executes the
+	// command
+	runtime.LockOSThread()
+
+	var i processInit
+	if err := json.Unmarshal([]byte(config), &i); err != nil {
+		return errors.Wrap(err, "invalid configuration")
+	}
+	if i.Sandbox != nil {
+		if err := i.Sandbox.setup(); err != nil {
+			return err
+		}
+	}
+	if err := i.Limits.apply(); err != nil {
+		return err
+	}
+	if i.Sandbox != nil {
+		if err := dropCapabilities(); err != nil {
+			return err
+		}
+	}
+
+	return syscall.Exec(args[0], args[1:], os.Environ())
+}
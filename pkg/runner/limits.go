@@ -0,0 +1,111 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/pkg/errors"
+)
+
+// Limits are resource limits applied to the processes of a command and
+// their children, with setrlimit. Sizes are as "512m" or "1g", CPUTime is a
+// duration. They are only supported on Linux.
+type Limits struct {
+	// Memory limits the address space of each process
+	Memory    string `yaml:"memory"`
+	CPUTime   string `yaml:"cpuTime"`
+	OpenFiles uint64 `yaml:"openFiles"`
+	// FileSize is the largest file a process can write
+	FileSize string `yaml:"fileSize"`
+}
+
+// Usage is the resource usage of a process and of its children.
+type Usage struct {
+	UserTime, SystemTime time.Duration
+	// MaxRSS is in bytes
+	MaxRSS int64
+}
+
+// Add returns the usage of running both processes one after the other.
+func (u Usage) Add(o Usage) Usage {
+	res := Usage{
+		UserTime:   u.UserTime + o.UserTime,
+		SystemTime: u.SystemTime + o.SystemTime,
+		MaxRSS:     u.MaxRSS,
+	}
+	if o.MaxRSS > res.MaxRSS {
+		res.MaxRSS = o.MaxRSS
+	}
+	return res
+}
+
+// CPUTime is the user and system time spent.
+func (u Usage) CPUTime() time.Duration {
+	return u.UserTime + u.SystemTime
+}
+
+func (l Limits) empty() bool {
+	return l == Limits{}
+}
+
+// Validate checks that sizes and durations can be parsed.
+func (l Limits) Validate() error {
+	_, err := l.parse()
+	return err
+}
+
+// parsedLimits are the limits in bytes and seconds, 0 is unlimited
+type parsedLimits struct {
+	memory, fileSize, cpuTime, openFiles uint64
+}
+
+func (l Limits) parse() (parsedLimits, error) {
+	res := parsedLimits{openFiles: l.OpenFiles}
+	size := func(name, s string) (uint64, error) {
+		if len(s) == 0 {
+			return 0, nil
+		}
+		v, err := units.RAMInBytes(s)
+		if err != nil {
+			return 0, errors.Wrapf(err, "invalid %s limit", name)
+		}
+		if v <= 0 {
+			return 0, errors.Errorf("invalid %s limit '%s'", name, s)
+		}
+		return uint64(v), nil
+	}
+
+	var err error
+	if res.memory, err = size("memory", l.Memory); err != nil {
+		return res, err
+	}
+	if res.fileSize, err = size("file size", l.FileSize); err != nil {
+		return res, err
+	}
+
+	cpu, err := parseDuration(l.CPUTime)
+	if err != nil {
+		return res, errors.Wrap(err, "invalid cpu time limit")
+	}
+	if cpu > 0 {
+		// Limits are in seconds, and rounding down to 0 would be unlimited
+		res.cpuTime = uint64(cpu / time.Second)
+		if cpu%time.Second != 0 {
+			res.cpuTime++
+		}
+	}
+	return res, nil
+}
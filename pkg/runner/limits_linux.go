@@ -0,0 +1,81 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// rlimit is a resource with its limit
+type rlimit struct {
+	resource int
+	value    uint64
+}
+
+func (l Limits) rlimits() ([]rlimit, error) {
+	p, err := l.parse()
+	if err != nil {
+		return nil, err
+	}
+	var res []rlimit
+	for _, r := range []rlimit{
+		{resource: unix.RLIMIT_AS, value: p.memory},
+		{resource: unix.RLIMIT_FSIZE, value: p.fileSize},
+		{resource: unix.RLIMIT_CPU, value: p.cpuTime},
+		{resource: unix.RLIMIT_NOFILE, value: p.openFiles},
+	} {
+		if r.value > 0 {
+			res = append(res, r)
+		}
+	}
+	return res, nil
+}
+
+// limit makes the process apply the limits to itself before executing the
+// command, they are inherited by the processes it starts. See reexec.
+func limit(cmd *exec.Cmd, l Limits) error {
+	if _, err := l.rlimits(); err != nil {
+		return err
+	}
+	return reexec(cmd, func(i *processInit) {
+		i.Limits = l
+	})
+}
+
+func (l Limits) apply() error {
+	limits, err := l.rlimits()
+	if err != nil {
+		return err
+	}
+	for _, r := range limits {
+		if err := unix.Setrlimit(r.resource, &unix.Rlimit{Cur: r.value, Max: r.value}); err != nil {
+			return errors.Wrap(err, "while setting resource limits")
+		}
+	}
+	return nil
+}
+
+func processUsage(state *os.ProcessState) Usage {
+	u := Usage{UserTime: state.UserTime(), SystemTime: state.SystemTime()}
+	if r, ok := state.SysUsage().(*syscall.Rusage); ok {
+		// Linux reports it in kilobytes
+		u.MaxRSS = int64(r.Maxrss) * 1024
+	}
+	return u
+}
@@ -0,0 +1,184 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"github.com/pkg/errors"
+)
+
+// combinations returns all the combinations of the matrix values, keys are
+// taken in alphabetical order.
+func combinations(matrix map[string][]string) []map[string]string {
+	keys := []string{}
+	for k := range matrix {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := []map[string]string{{}}
+	for _, k := range keys {
+		var next []map[string]string
+		for _, combination := range res {
+			for _, v := range matrix[k] {
+				c := map[string]string{k: v}
+				for ck, cv := range combination {
+					c[ck] = cv
+				}
+				next = append(next, c)
+			}
+		}
+		res = next
+	}
+	return res
+}
+
+// matrixName returns the name of a command for a matrix combination, as
+// `name[key1=value1,key2=value2]`
+func matrixName(name string, combination map[string]string) string {
+	pairs := []string{}
+	for k, v := range combination {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return name + "[" + strings.Join(pairs, ",") + "]"
+}
+
+// matrixEnv returns the matrix values as CHARTY_MATRIX_<KEY> variables
+func matrixEnv(combination map[string]string) map[string]string {
+	env := map[string]string{}
+	for k, v := range combination {
+		env["CHARTY_MATRIX_"+strings.ToUpper(k)] = v
+	}
+	return env
+}
+
+var (
+	matrixReference = regexp.MustCompile(`{{-?\s*\.Matrix\.([A-Za-z0-9_]+)\s*-?}}`)
+	matrixAction    = regexp.MustCompile(`{{[^}]*\.Matrix\b[^}]*}}`)
+)
+
+// renderMatrix replaces the {{ .Matrix.key }} references with the values
+// of the combination, and renders the other actions using them, as
+// {{ .Matrix.key | upper }}. Other template actions are left as they are,
+// to be rendered later or to be given as-is to the commands.
+func renderMatrix(s string, combination map[string]string) (string, error) {
+	var err error
+	res := matrixReference.ReplaceAllStringFunc(s, func(ref string) string {
+		key := matrixReference.FindStringSubmatch(ref)[1]
+		v, ok := combination[key]
+		if !ok {
+			err = errors.Errorf("unknown matrix key '%s'", key)
+		}
+		return v
+	})
+	if err != nil {
+		return res, err
+	}
+	return renderActions(res, matrixAction, map[string]interface{}{"Matrix": combination})
+}
+
+// renderActions renders the template actions matched by the expression
+// with the data, and the functions available in the charts. Referring to
+// missing keys is an error.
+func renderActions(s string, action *regexp.Regexp, data map[string]interface{}) (string, error) {
+	var err error
+	res := action.ReplaceAllStringFunc(s, func(a string) string {
+		if err != nil {
+			return a
+		}
+		var t *template.Template
+		t, err = template.New("").Funcs(sprig.TxtFuncMap()).Option("missingkey=error").Parse(a)
+		if err != nil {
+			return a
+		}
+		var out strings.Builder
+		if err = t.Execute(&out, data); err != nil {
+			return a
+		}
+		return out.String()
+	})
+	return res, errors.Wrap(err, "while rendering")
+}
+
+// renderMatrix renders the values of the combination in pre, run, post,
+// the hooks, script and stdin
+func (c *Command) renderMatrix(combination map[string]string) error {
+	for _, f := range []*string{&c.Pre, &c.Run, &c.Post, &c.OnSuccess, &c.OnFailure, &c.Always, &c.Script, &c.Stdin} {
+		rendered, err := renderMatrix(*f, combination)
+		if err != nil {
+			return errors.Wrapf(err, "while rendering command '%s'", c.Name)
+		}
+		*f = rendered
+	}
+	return nil
+}
+
+// Expand returns the commands with the ones having a matrix replaced by a
+// command for each combination of the matrix values. Needs referring to a
+// matrix command are replaced by all its combinations.
+func (l Commands) Expand() (Commands, error) {
+	expanded := map[string][]string{}
+	res := Commands{}
+	for _, c := range l {
+		if len(c.Matrix) == 0 {
+			// References to the matrix can't be resolved
+			if err := c.renderMatrix(nil); err != nil {
+				return l, err
+			}
+			res = append(res, c)
+			continue
+		}
+
+		for k, values := range c.Matrix {
+			if len(values) == 0 {
+				return l, errors.Errorf("matrix key '%s' of command '%s' has no values", k, c.Name)
+			}
+		}
+
+		for _, combination := range combinations(c.Matrix) {
+			e := c
+			e.Matrix = nil
+			e.Name = matrixName(c.Name, combination)
+			e.MatrixValues = combination
+			if err := e.renderMatrix(combination); err != nil {
+				return l, err
+			}
+			res = append(res, e)
+			expanded[c.Name] = append(expanded[c.Name], e.Name)
+		}
+	}
+
+	if len(expanded) == 0 {
+		return res, nil
+	}
+
+	for i, c := range res {
+		var needs []string
+		for _, n := range c.Needs {
+			if names, ok := expanded[n]; ok {
+				needs = append(needs, names...)
+			} else {
+				needs = append(needs, n)
+			}
+		}
+		res[i].Needs = needs
+	}
+	return res, nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	stepReference  = regexp.MustCompile(`{{-?\s*\.Steps\.([A-Za-z0-9_-]+)\.outputs\.([A-Za-z0-9_-]+)\s*-?}}`)
+	stepAction     = regexp.MustCompile(`{{[^}]*\.Steps\b[^}]*}}`)
+	unsafeEnvChars = regexp.MustCompile(`[^A-Z0-9_]`)
+)
+
+// steps returns the outputs of the completed commands, added to the ones
+// a command already had from a previous run of the schedule.
+func steps(previous map[string]map[string]string, results map[string]CommandOutput) map[string]map[string]string {
+	res := map[string]map[string]string{}
+	for name, outputs := range previous {
+		res[name] = outputs
+	}
+	for name, r := range results {
+		if r.Outputs != nil {
+			res[name] = r.Outputs
+		}
+	}
+	return res
+}
+
+// stepsEnv returns the outputs of the completed commands as environment
+// variables, as CHARTY_STEP_NAME_KEY
+func stepsEnv(steps map[string]map[string]string) map[string]string {
+	env := map[string]string{}
+	for name, outputs := range steps {
+		for k, v := range outputs {
+			env[unsafeEnvChars.ReplaceAllString(strings.ToUpper("CHARTY_STEP_"+name+"_"+k), "_")] = v
+		}
+	}
+	return env
+}
+
+// renderSteps replaces the {{ .Steps.name.outputs.key }} references with
+// the outputs of the completed commands, as renderMatrix does.
+func renderSteps(s string, steps map[string]map[string]string) (string, error) {
+	var err error
+	res := stepReference.ReplaceAllStringFunc(s, func(ref string) string {
+		m := stepReference.FindStringSubmatch(ref)
+		outputs, ok := steps[m[1]]
+		if !ok {
+			err = errors.Errorf("no outputs of command '%s', it must be needed by the command", m[1])
+			return ""
+		}
+		v, ok := outputs[m[2]]
+		if !ok {
+			err = errors.Errorf("command '%s' has no output '%s'", m[1], m[2])
+		}
+		return v
+	})
+	if err != nil {
+		return res, err
+	}
+
+	data := map[string]map[string]map[string]string{}
+	for name, outputs := range steps {
+		data[name] = map[string]map[string]string{"outputs": outputs}
+	}
+	return renderActions(res, stepAction, map[string]interface{}{"Steps": data})
+}
+
+// withSteps returns the command with the outputs of the commands it
+// refers to rendered in pre, run, post, the hooks, script and stdin
+func (c Command) withSteps() (Command, error) {
+	for _, f := range []*string{&c.Pre, &c.Run, &c.Post, &c.OnSuccess, &c.OnFailure, &c.Always, &c.Script, &c.Stdin} {
+		rendered, err := renderSteps(*f, c.steps)
+		if err != nil {
+			return c, errors.Wrap(err, "while rendering outputs")
+		}
+		*f = rendered
+	}
+	return c, nil
+}
+
+// validateOutputs checks the output captures have a group
+func (c Command) validateOutputs() error {
+	for k, expr := range c.Outputs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid capture of output '%s'", k)
+		}
+		if re.NumSubexp() == 0 {
+			return errors.Errorf("capture of output '%s' has no group", k)
+		}
+	}
+	return nil
+}
+
+// captureOutputs returns the first group of the first match of every
+// output capture in the standard output of the run phase. Outputs which
+// didn't match are left out.
+func (c Command) captureOutputs(stdout string) map[string]string {
+	outputs := map[string]string{}
+	for k, expr := range c.Outputs {
+		// Captures are checked by Validate
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			continue
+		}
+		if m := re.FindStringSubmatch(stdout); m != nil {
+			outputs[k] = m[1]
+		}
+	}
+	return outputs
+}
+
+// resetOutputFile empties the output file of an attempt
+func resetOutputFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return errors.Wrap(err, "while creating outputs directory")
+	}
+	return errors.Wrap(ioutil.WriteFile(path, []byte{}, 0644), "while creating output file")
+}
+
+// readOutputFile parses the dotenv output file written by the command
+func readOutputFile(path string) (map[string]string, error) {
+	dat, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "while reading output file")
+	}
+	outputs, err := parseDotEnv(string(dat))
+	return outputs, errors.Wrap(err, "while parsing output file")
+}
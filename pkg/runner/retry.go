@@ -0,0 +1,67 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// backoff returns the delay for the next attempt. Factors below 1 keep the
+// delay constant.
+func backoff(delay time.Duration, factor float64) time.Duration {
+	if factor <= 1 {
+		return delay
+	}
+	return time.Duration(float64(delay) * factor)
+}
+
+// rerunFailed runs again the commands which failed in a previous pass, and
+// returns the results with the new attempts appended to the old ones.
+// Commands which were not run are left untouched.
+func rerunFailed(ctx context.Context, results []CommandOutput, o scheduleOptions) []CommandOutput {
+	var failed Commands
+	var indexes []int
+	for i, r := range results {
+		// Commands whose condition couldn't be evaluated were never
+		// started
+		if r.Error == nil || r.Skipped || len(r.Attempts) == 0 {
+			continue
+		}
+		c := r.Command
+		// What they needed already completed, and their condition was
+		// true in the main pass
+		c.Needs = nil
+		c.If = ""
+		failed = append(failed, c)
+		indexes = append(indexes, i)
+	}
+
+	if len(failed) == 0 {
+		return results
+	}
+
+	log.WithField("commands", len(failed)).Info("Running failed commands again")
+
+	res := append([]CommandOutput{}, results...)
+	for i, out := range failed.schedule(ctx, o) {
+		previous := results[indexes[i]]
+		out.Command = previous.Command
+		out.Attempts = append(append([]CommandOutput{}, previous.Attempts...), out.Attempts...)
+		res[indexes[i]] = out
+	}
+	return res
+}
@@ -15,41 +15,168 @@ package runner
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/codeskyblue/kexec"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/imdario/mergo"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
 )
 
 type Chart interface {
 	RunnerDirectory() string
+	// RuntimeDefaults are the runtime options of the chart, already
+	// rendered with the chart values
 	RuntimeDefaults() map[string]interface{}
+	Name() string
+	Version() string
+	// MergedValues are the chart values, merged with the defaults
+	MergedValues() map[string]interface{}
+	// Render renders a template as the chart templates are
+	Render(id, template string) (string, error)
 }
 
 type Options struct {
 	Commands Commands `yaml:"commands"`
 	Pre      []string `yaml:"pre"`
 	Post     []string `yaml:"post"`
+	Parallel int      `yaml:"parallel"`
+	Timeout  string   `yaml:"timeout"`
+	// FailFast stops the run at the first failure, post commands still run
+	FailFast bool `yaml:"failFast"`
+	// PostTimeout is the deadline of the global post commands, and of each
+	// kind of global hooks
+	PostTimeout string `yaml:"postTimeout"`
+	// Shell is the default interpreter of the commands, see Command.Shell
+	Shell string `yaml:"shell"`
+
+	// Hooks run after post, depending on the outcome of the run, even if
+	// it timed out or was interrupted. Always runs last. Post doesn't run if
+	// pre failed, the hooks do.
+	OnSuccess []string `yaml:"onSuccess"`
+	OnFailure []string `yaml:"onFailure"`
+	Always    []string `yaml:"always"`
+
+	// RerunFailed is the number of passes over the failed commands once
+	// all the commands ran
+	RerunFailed int `yaml:"rerunFailed"`
+
+	// Env is inherited by all the commands, EnvFiles are dotenv files
+	// relative to the runner directory
+	Env      map[string]string `yaml:"env"`
+	EnvFiles []string          `yaml:"envFiles"`
+
+	// Executor is the default executor of the commands, Sandbox and SSH the
+	// options of the sandbox and ssh executors. See Command.Executor.
+	Executor string          `yaml:"executor"`
+	Sandbox  SandboxExecutor `yaml:"sandbox"`
+	SSH      SSHOptions      `yaml:"ssh"`
+
+	// Shuffle randomises the order the commands start in, which still
+	// follows their needs. ShuffleSeed replays the order of a previous
+	// run, it's random if not set.
+	Shuffle     bool  `yaml:"shuffle"`
+	ShuffleSeed int64 `yaml:"shuffleSeed"`
+
+	// Focus and Skip are regular expressions matched against the names of
+	// the commands. Tags and ExcludeTags are tag expressions, as "a+!b"
+	// for the commands having a but not b. Only the commands matching
+	// Focus and one of Tags run, when they're set, unless they match Skip
+	// or one of ExcludeTags. The commands they need run as well, unless
+	// excluded.
+	Focus       string   `yaml:"focus"`
+	Skip        string   `yaml:"skip"`
+	Tags        []string `yaml:"tags"`
+	ExcludeTags []string `yaml:"excludeTags"`
+
+	// Changed are paths, relative to the runner directory, which changed
+	// since the last run. Only the commands referring to them run, with
+	// the ones they need and the ones needing them, the others are
+	// reported as skipped. All the commands run if none refers to them.
+	Changed []string `yaml:"-"`
 }
 
-type TestRunner struct{}
+type TestRunner struct {
+	// Output is where the output of the commands is streamed to, it
+	// defaults to the stdout and stderr of the current process.
+	Output OutputSink
+	// Executors are the executors which commands can select by name,
+	// besides the built in ones
+	Executors map[string]Executor
+}
 
-func (t *TestRunner) runAndFail(c []string, path string) (string, error) {
+func (t *TestRunner) output() OutputSink {
+	if t.Output == nil {
+		return StdSink
+	}
+	return t.Output
+}
+
+// runAndFail runs the global commands, which always run on the host, and
+// stops at the first failure.
+func (t *TestRunner) runAndFail(ctx context.Context, name string, c []string, path, shell string, env map[string]string) (string, error) {
 	var o string
+	if len(c) == 0 {
+		return o, nil
+	}
+
+	sink := t.output()
+	var logWriter io.Writer
+	logFile, err := openLog(path, name)
+	if err != nil {
+		log.WithField("name", name).Warn("Can't write the command log: " + err.Error())
+	} else {
+		defer logFile.Close()
+		logWriter = logFile
+	}
+
 	for _, p := range c {
-		out, err := runProc(p, path)
+		if logFile != nil {
+			fmt.Fprintf(logFile, "==> %s %s\n", time.Now().Format(time.RFC3339), p)
+		}
+		out, err := runProc(ctx, Process{
+			Shell:     strings.Fields(shell),
+			Command:   p,
+			Dir:       path,
+			RunnerDir: path,
+			Env:       environ(env),
+			Stdout:    sink.Stdout(Command{Name: name, Run: p}),
+			Stderr:    sink.Stderr(Command{Name: name, Run: p}),
+			Log:       logWriter,
+		}, nil)
 		if err != nil {
-			return o, errors.Wrap(err, "failed running "+p)
+			return o + out.Output, errors.Wrap(err, "failed running "+p)
 		}
-		o = o + out
+		o = o + out.Output
 	}
 	return o, nil
 }
 
+// runHooks runs the global hooks, all of them even if some fail.
+func (t *TestRunner) runHooks(ctx context.Context, name string, c []string, path, shell string, env map[string]string) (string, error) {
+	var o string
+	var ret error
+	for _, p := range c {
+		out, err := t.runAndFail(ctx, name, []string{p}, path, shell, env)
+		o = o + out
+		if err != nil {
+			ret = multierror.Append(ret, err)
+		}
+	}
+	return o, ret
+}
+
 func interfaceToOptions(m map[string]interface{}) (Options, error) {
 	dat, err := yaml.Marshal(m)
 	if err != nil {
@@ -60,56 +187,469 @@ func interfaceToOptions(m map[string]interface{}) (Options, error) {
 	return opts, err
 }
 
-func (t *TestRunner) Run(c Chart, o Options) ([]CommandOutput, error) {
+// options merges the options with the runtime options of the chart
+func options(c Chart, o Options) (Options, error) {
+	opts, err := interfaceToOptions(c.RuntimeDefaults())
+	if err != nil {
+		return opts, err
+	}
+
+	err = mergo.Merge(&opts, o, mergo.WithOverride)
+	return opts, err
+}
+
+// commands returns the commands to run in order, with the ones which are
+// not run because of the filters or the changes marked as skipped, and the
+// seed they were shuffled with.
+func (o Options) commands() (Commands, int64, error) {
+	expanded, err := o.Commands.Expand()
+	if err != nil {
+		return expanded, 0, errors.Wrap(err, "invalid commands")
+	}
+	if err := expanded.Validate(); err != nil {
+		return expanded, 0, errors.Wrap(err, "invalid commands")
+	}
+	if affected := expanded.affected(o.Changed); len(affected) > 0 {
+		for i := range expanded {
+			if !affected[expanded[i].Name] {
+				expanded[i].skip = "not affected by the changes"
+			}
+		}
+	}
+	if err := o.filter(expanded); err != nil {
+		return expanded, 0, errors.Wrap(err, "invalid filters")
+	}
+
+	seed := o.ShuffleSeed
+	if o.Shuffle || seed != 0 {
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		expanded.shuffle(seed)
+		log.WithField("seed", seed).Info("Shuffled the commands, run again with the seed to get the same order")
+	}
+	return expanded, seed, nil
+}
+
+// List returns the commands of the chart as Run would run them, in order,
+// without running anything. The commands which would not run because of
+// the filters or the changes are reported as skipped.
+func (t *TestRunner) List(c Chart, o Options) ([]CommandOutput, error) {
+	res := []CommandOutput{}
+	opts, err := options(c, o)
+	if err != nil {
+		return res, err
+	}
+	commands, seed, err := opts.commands()
+	if err != nil {
+		return res, err
+	}
+	for _, cmd := range commands {
+		res = append(res, CommandOutput{Command: cmd, Skipped: len(cmd.skip) > 0, SkipReason: cmd.skip, ShuffleSeed: seed})
+	}
+	return res, nil
+}
+
+// Run runs the chart commands. When the context is cancelled the running
+// commands are stopped, the remaining ones are not started and the global
+// post commands are run.
+func (t *TestRunner) Run(ctx context.Context, c Chart, o Options) ([]CommandOutput, error) {
 	res := []CommandOutput{}
 	var ret error
 
 	// Merge runtime options with what provided from the chart
-	opts, err := interfaceToOptions(c.RuntimeDefaults())
+	opts, err := options(c, o)
+	if err != nil {
+		return res, err
+	}
+	expanded, seed, err := opts.commands()
 	if err != nil {
 		return res, err
 	}
 
-	if err := mergo.Merge(&opts, o, mergo.WithOverride); err != nil {
+	timeout, err := parseDuration(opts.Timeout)
+	if err != nil {
+		return res, errors.Wrap(err, "invalid timeout")
+	}
+
+	fileEnv, err := loadEnvFiles(c.RunnerDirectory(), opts.EnvFiles)
+	if err != nil {
 		return res, err
 	}
+	env := mergeEnv(fileEnv, opts.Env)
+	builtin := map[string]string{
+		"CHARTY_CHART_NAME":    c.Name(),
+		"CHARTY_CHART_VERSION": c.Version(),
+		"CHARTY_RUNNER_DIR":    c.RunnerDirectory(),
+	}
+	values := c.MergedValues()
+	remote := NewSSHExecutor(opts.SSH)
+	defer remote.Close()
+	commands := Commands{}
+	for _, cmd := range expanded {
+		cmd.inheritedEnv = env
+		cmd.builtinEnv = builtin
+		cmd.values = values
+		cmd.output = t.output()
+		// Commands of the chart were rendered with its runtime options,
+		// rendering them again would evaluate what was escaped
+		if len(o.Commands) > 0 {
+			cmd.render = c.Render
+		}
+		if len(cmd.Shell) == 0 {
+			cmd.Shell = opts.Shell
+		}
+		if len(cmd.Executor) == 0 {
+			cmd.Executor = opts.Executor
+		}
+		cmd.executor, err = t.executor(cmd, opts.Sandbox, remote)
+		if err != nil {
+			return res, errors.Wrap(err, "invalid commands")
+		}
+		commands = append(commands, cmd)
+	}
+
+	postTimeout, err := parseDuration(opts.PostTimeout)
+	if err != nil {
+		return res, errors.Wrap(err, "invalid post timeout")
+	}
 
-	if out, err := t.runAndFail(opts.Pre, c.RunnerDirectory()); err != nil {
-		res = append(res, CommandOutput{Command: Command{Name: "global-pre-run"}, Error: err, Output: out})
-		ret = multierror.Append(ret, err)
-		return res, ret
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	results := opts.Commands.Start(c.RunnerDirectory())
-	for _, r := range results {
-		if r.Error != nil {
-			ret = multierror.Append(ret, r.Error)
+	globalEnv := mergeEnv(env, builtin)
+	pre, preErr := t.runAndFail(ctx, "global-pre-run", opts.Pre, c.RunnerDirectory(), opts.Shell, globalEnv)
+	if preErr != nil {
+		res = append(res, CommandOutput{Command: Command{Name: "global-pre-run"}, Error: preErr, Output: pre, LogFile: LogFile(c.RunnerDirectory(), "global-pre-run"), FailedPhase: "pre"})
+		ret = multierror.Append(ret, preErr)
+		for _, cmd := range commands {
+			res = append(res, CommandOutput{Command: cmd, Skipped: true, SkipReason: "global pre failed"})
+		}
+	} else {
+		schedule := scheduleOptions{
+			Parallel: opts.Parallel,
+			FailFast: opts.FailFast,
+			Start: func(ctx context.Context, cmd Command) CommandOutput {
+				return cmd.Start(ctx, c.RunnerDirectory())
+			},
+		}
+		results := commands.schedule(ctx, schedule)
+		for i := 0; i < opts.RerunFailed && ctx.Err() == nil; i++ {
+			results = rerunFailed(ctx, results, schedule)
+		}
+		for _, r := range results {
+			if r.Failed() {
+				ret = multierror.Append(ret, r.Error)
+			}
+		}
+		res = append(res, results...)
+	}
+
+	// Cleanup runs even if the run timed out or was interrupted, in the
+	// latter case with a default deadline
+	if ctx.Err() == context.Canceled {
+		ret = multierror.Append(ret, errors.New("run interrupted"))
+		if postTimeout == 0 {
+			postTimeout = DefaultPostTimeout
+		}
+	}
+	cleanup := func(name string, cmds []string, run func(context.Context, string, []string, string, string, map[string]string) (string, error)) {
+		if len(cmds) == 0 {
+			return
+		}
+		cleanupCtx, cancel := context.WithCancel(context.Background())
+		if postTimeout > 0 {
+			cleanupCtx, cancel = context.WithTimeout(context.Background(), postTimeout)
+		}
+		defer cancel()
+		out, err := run(cleanupCtx, name, cmds, c.RunnerDirectory(), opts.Shell, globalEnv)
+		if err != nil {
+			ret = multierror.Append(ret, err)
+		}
+		// Hooks are always reported, post only when it fails
+		if err != nil || name != "global-post-run" {
+			res = append(res, CommandOutput{Command: Command{Name: name}, Error: err, Output: out, LogFile: LogFile(c.RunnerDirectory(), name)})
 		}
 	}
-	res = append(res, results...)
 
-	if out, err := t.runAndFail(opts.Post, c.RunnerDirectory()); err != nil {
-		res = append(res, CommandOutput{Command: Command{Name: "global-post-run"}, Error: err, Output: out})
-		ret = multierror.Append(ret, err)
-		return res, ret
+	// post is the counterpart of pre, the hooks run in any case
+	if preErr == nil {
+		cleanup("global-post-run", opts.Post, t.runAndFail)
 	}
+	if ret == nil {
+		cleanup("global-on-success", opts.OnSuccess, t.runHooks)
+	} else {
+		cleanup("global-on-failure", opts.OnFailure, t.runHooks)
+	}
+	cleanup("global-always", opts.Always, t.runHooks)
 
+	for i := range res {
+		res[i].ShuffleSeed = seed
+	}
 	return res, ret
 }
 
-func runProc(cmd, dir string) (string, error) {
+// DefaultPostTimeout is the deadline of the global post commands after the
+// run was interrupted, if none is set in the options.
+var DefaultPostTimeout = time.Minute
+
+// TerminateGracePeriod is the time given to a process group to exit after
+// SIGTERM, before being killed with SIGKILL.
+var TerminateGracePeriod = 10 * time.Second
+
+// TimeoutError is returned for processes which were stopped because they
+// ran past their deadline, or didn't produce output for too long.
+type TimeoutError struct {
+	Reason string
+}
+
+func (e *TimeoutError) Error() string {
+	return e.Reason
+}
+
+func isTimeout(err error) bool {
+	_, ok := err.(*TimeoutError)
+	return ok
+}
+
+func isInterrupted(err error) bool {
+	return errors.Cause(err) == context.Canceled
+}
+
+// parseDuration parses durations as "1m30s", bare numbers are seconds.
+func parseDuration(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	if secs, err := strconv.Atoi(s); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// activityBuffer collects process output and records when it was last
+// written to.
+type activityBuffer struct {
+	sync.Mutex
+	b    bytes.Buffer
+	last time.Time
+}
+
+func (a *activityBuffer) Write(p []byte) (int, error) {
+	a.Lock()
+	defer a.Unlock()
+	a.last = time.Now()
+	return a.b.Write(p)
+}
+
+func (a *activityBuffer) String() string {
+	a.Lock()
+	defer a.Unlock()
+	return a.b.String()
+}
+
+func (a *activityBuffer) idle() time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	return time.Since(a.last)
+}
+
+// DefaultShell is the interpreter of commands which don't set one
+var DefaultShell = []string{"/bin/bash"}
 
-	p := kexec.CommandString(cmd)
+// Process is a process run by an Executor.
+type Process struct {
+	// Shell is the interpreter and its arguments. Command is given to it
+	// with -c, or as argument when File is set.
+	Shell   []string
+	File    bool
+	Command string
+	Stdin   io.Reader
+	// Dir is the working directory, inside of RunnerDir unless the command
+	// allows external directories
+	Dir, RunnerDir string
+	Inactivity     time.Duration
+	Limits         Limits
+	// Env is added to the environment of the current process
+	Env []string
+	// Stdout and Stderr are where output is streamed to, besides being
+	// captured. Log gets both of them.
+	Stdout, Stderr, Log io.Writer
+}
+
+// PhaseOutput is the result of one of the pre, run and post processes of
+// a command.
+type PhaseOutput struct {
+	Command string
+	// Output has stdout and stderr interleaved as they were written
+	Output, Stdout, Stderr string
+	// ExitCode is -1 if the process didn't exit on its own, Signal is the
+	// name of the signal which terminated it if any
+	ExitCode   int
+	Signal     string
+	Start, End time.Time
+	Usage      Usage
+	Error      error
+}
+
+// runProc runs a process, stopping it when the context is done or it is
+// inactive for too long. prepare can change how the process is started.
+func runProc(ctx context.Context, pr Process, prepare func(*exec.Cmd) error) (PhaseOutput, error) {
+	args := pr.args()
+	p := kexec.Command(args[0], args[1:]...)
+	c := newCapture(pr)
+	p.Stdout, p.Stderr = c.writers()
+	p.Dir = pr.Dir
+	p.Stdin = pr.Stdin
+	p.Env = append(os.Environ(), pr.Env...)
+	if prepare != nil {
+		if err := prepare(p.Cmd); err != nil {
+			return PhaseOutput{Command: pr.Command, ExitCode: -1, Error: err}, err
+		}
+	}
+	if !pr.Limits.empty() {
+		if err := limit(p.Cmd, pr.Limits); err != nil {
+			return PhaseOutput{Command: pr.Command, ExitCode: -1, Error: err}, err
+		}
+	}
+
+	result := func(err error) (PhaseOutput, error) {
+		out := c.output(err)
+		if state := p.ProcessState; state != nil {
+			out.ExitCode = state.ExitCode()
+			out.Usage = processUsage(state)
+			if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				out.Signal = signalName(status.Signal())
+			}
+		}
+		return out, err
+	}
+
+	if err := p.Start(); err != nil {
+		return result(err)
+	}
+	err, stopped := supervise(ctx, pr, c.all, p.Wait, func(sig syscall.Signal) {
+		p.Terminate(sig)
+	})
+	if stopped != nil {
+		return result(stopped)
+	}
+	return result(err)
+}
+
+// args are the shell and its arguments to run the command
+func (pr Process) args() []string {
+	shell := pr.Shell
+	if len(shell) == 0 {
+		shell = DefaultShell
+	}
+	args := append([]string{}, shell...)
+	if !pr.File {
+		args = append(args, "-c")
+	}
+	return append(args, pr.Command)
+}
+
+// capture collects the output of a process while streaming it
+type capture struct {
+	pr             Process
+	all            *activityBuffer
+	stdout, stderr bytes.Buffer
+	start          time.Time
+}
+
+func newCapture(pr Process) *capture {
+	if pr.Stdout == nil {
+		pr.Stdout = os.Stdout
+	}
+	if pr.Stderr == nil {
+		pr.Stderr = os.Stderr
+	}
+	return &capture{pr: pr, all: &activityBuffer{last: time.Now()}, start: time.Now()}
+}
+
+// writers returns the stdout and stderr of the process
+func (c *capture) writers() (io.Writer, io.Writer) {
+	stdoutWriters := []io.Writer{c.pr.Stdout, c.all, &c.stdout}
+	stderrWriters := []io.Writer{c.pr.Stderr, c.all, &c.stderr}
+	if c.pr.Log != nil {
+		stdoutWriters = append(stdoutWriters, c.pr.Log)
+		stderrWriters = append(stderrWriters, c.pr.Log)
+	}
+	return io.MultiWriter(stdoutWriters...), io.MultiWriter(stderrWriters...)
+}
 
-	var b bytes.Buffer
-	p.Stdout = io.MultiWriter(os.Stdout, &b)
-	p.Stderr = io.MultiWriter(os.Stderr, &b)
-	p.Dir = dir
-	if err := p.Run(); err != nil {
-		return b.String(), err
+// output returns the output of the process once it exited
+func (c *capture) output(err error) PhaseOutput {
+	flush(c.pr.Stdout, c.pr.Stderr)
+	return PhaseOutput{
+		Command:  c.pr.Command,
+		Output:   c.all.String(),
+		Stdout:   c.stdout.String(),
+		Stderr:   c.stderr.String(),
+		ExitCode: -1,
+		Start:    c.start,
+		End:      time.Now(),
+		Error:    err,
 	}
+}
 
-	p.Wait()
+// supervise waits for a started process. When the context is done, or the
+// process didn't write any output for too long, it is stopped with
+// SIGTERM, and SIGKILL if it doesn't exit in time. It returns the error
+// wait returned, and the reason the process was stopped if it was.
+func supervise(ctx context.Context, pr Process, b *activityBuffer, wait func() error, terminate func(syscall.Signal)) (error, error) {
+	exited := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		err := wait()
+		close(exited)
+		done <- err
+	}()
 
-	return b.String(), nil
+	var idle <-chan time.Time
+	if pr.Inactivity > 0 {
+		ticker := time.NewTicker(pr.Inactivity / 10)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+
+	var stopped error
+	stop := func(reason error) {
+		if stopped != nil {
+			return
+		}
+		stopped = reason
+		idle = nil
+		terminate(syscall.SIGTERM)
+		go func() {
+			select {
+			case <-exited:
+			case <-time.After(TerminateGracePeriod):
+				terminate(syscall.SIGKILL)
+			}
+		}()
+	}
+
+	cancelled := ctx.Done()
+	for {
+		select {
+		case err := <-done:
+			return err, stopped
+		case <-cancelled:
+			cancelled = nil
+			if ctx.Err() == context.DeadlineExceeded {
+				stop(&TimeoutError{Reason: "timed out: '" + pr.Command + "'"})
+			} else {
+				stop(errors.Wrap(ctx.Err(), "interrupted: '"+pr.Command+"'"))
+			}
+		case <-idle:
+			if b.idle() >= pr.Inactivity {
+				stop(&TimeoutError{Reason: fmt.Sprintf("no output for %s: '%s'", pr.Inactivity, pr.Command)})
+			}
+		}
+	}
 }
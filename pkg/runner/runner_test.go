@@ -14,6 +14,13 @@ limitations under the License.
 package runner_test
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
 	runner "github.com/mudler/charty/pkg/runner"
 	test "github.com/mudler/charty/pkg/testchart"
 	. "github.com/onsi/ginkgo"
@@ -44,9 +51,9 @@ var _ = Describe("Testrunner", func() {
 		})
 
 		It("executes test correctly", func() {
-			err := testchart.Load("../../test/fixture")
+			err := testchart.Load(context.Background(), "../../test/fixture")
 			Expect(err).ToNot(HaveOccurred())
-			out, err := testrunner.Run(testchart, runner.Options{})
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{})
 
 			Expect(globstring(out)).To(Equal("Foo testreal\n"))
 			Expect(err).ToNot(HaveOccurred())
@@ -54,9 +61,9 @@ var _ = Describe("Testrunner", func() {
 
 		It("interpolates", func() {
 			testchart.Values = map[string]interface{}{"foo": "foo"}
-			err := testchart.Load("../../test/fixture")
+			err := testchart.Load(context.Background(), "../../test/fixture")
 			Expect(err).ToNot(HaveOccurred())
-			out, err := testrunner.Run(testchart, runner.Options{})
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{})
 
 			Expect(globstring(out)).To(Equal("Foo testfoo\n"))
 			Expect(err).ToNot(HaveOccurred())
@@ -64,9 +71,9 @@ var _ = Describe("Testrunner", func() {
 
 		It("catches failures and overrides chart settings", func() {
 			testchart.Values = map[string]interface{}{"foo": "foo"}
-			err := testchart.Load("../../test/fixture")
+			err := testchart.Load(context.Background(), "../../test/fixture")
 			Expect(err).ToNot(HaveOccurred())
-			_, err = testrunner.Run(testchart, runner.Options{
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
 				Commands: []runner.Command{{
 					Name: "test",
 					Run:  "bash fail.sh",
@@ -75,5 +82,916 @@ var _ = Describe("Testrunner", func() {
 
 			Expect(err).To(HaveOccurred())
 		})
+
+		It("runs independent commands in parallel after their needs", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Parallel: 3,
+				Commands: []runner.Command{
+					{Name: "slow", Run: "sleep 0.5 && echo slow >> order"},
+					{Name: "dependent", Run: "echo dependent >> order", Needs: []string{"slow"}},
+					{Name: "fast", Run: "echo fast >> order && cat order"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(out)).To(Equal(3))
+			Expect(out[2].Output).To(Equal("fast\n"))
+
+			dat, err := ioutil.ReadFile(filepath.Join(testchart.RunnerDirectory(), "order"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dat)).To(Equal("fast\nslow\ndependent\n"))
+		})
+
+		It("does not run commands whose needs failed", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "deploy", Run: "bash fail.sh"},
+					{Name: "test", Run: "echo test", Needs: []string{"deploy"}},
+					{Name: "verify", Run: "echo verify", Needs: []string{"test"}},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Error).To(HaveOccurred())
+			Expect(out[1].Skipped).To(BeTrue())
+			Expect(out[1].Error).ToNot(HaveOccurred())
+			Expect(out[2].Skipped).To(BeTrue())
+			Expect(globstring(out)).To(Equal(""))
+		})
+
+		It("rejects unknown needs, duplicates and cycles before running anything", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Pre: []string{"touch pre"},
+				Commands: []runner.Command{
+					{Name: "a", Run: "echo a", Needs: []string{"b"}},
+					{Name: "b", Run: "echo b", Needs: []string{"a"}},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("cycle"))
+			Expect(len(out)).To(Equal(0))
+			Expect(filepath.Join(testchart.RunnerDirectory(), "pre")).ToNot(BeAnExistingFile())
+
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "a", Run: "echo a", Needs: []string{"missing"}},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("unknown command 'missing'"))
+
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "a", Run: "echo a"},
+					{Name: "a", Run: "echo again"},
+				},
+			})
+			Expect(err).To(MatchError(ContainSubstring("command 'a' is defined more than once")))
+
+			// Conditions can only look at the commands they wait for
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Parallel: 2,
+				Commands: []runner.Command{
+					{Name: "deploy", Run: "sleep 0.2; exit 1"},
+					{Name: "diagnose", If: `failed("deploy")`, Run: "echo diagnose"},
+				},
+			})
+			Expect(err).To(MatchError(ContainSubstring("condition of command 'diagnose' looks at 'deploy', which is not in its needs")))
+		})
+
+		It("stops commands which run past their timeout", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "hung", Run: "echo start; sleep 10; echo end", Timeout: "500ms"},
+					{Name: "silent", Run: "echo start; sleep 10; echo end", Inactivity: "500ms"},
+					{Name: "chatty", Run: "for i in 1 2 3 4; do echo $i; sleep 0.2; done", Inactivity: "500ms"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].TimedOut).To(BeTrue())
+			Expect(out[0].Output).To(Equal("start\n"))
+			Expect(out[0].Elapsed).To(BeNumerically("<", 5))
+			Expect(out[1].TimedOut).To(BeTrue())
+			Expect(out[1].Error.Error()).To(ContainSubstring("no output for 500ms"))
+			Expect(out[2].TimedOut).To(BeFalse())
+			Expect(out[2].Error).ToNot(HaveOccurred())
+		})
+
+		It("retries failed commands and keeps every attempt", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{
+						Name:         "eventually",
+						Run:          "echo try >> tries; test $(wc -l < tries) -ge 3",
+						Retries:      3,
+						RetryDelay:   "10ms",
+						RetryBackoff: 2,
+					},
+					{Name: "never", Run: "echo never; exit 1", Retries: 1},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Error).ToNot(HaveOccurred())
+			Expect(len(out[0].Attempts)).To(Equal(3))
+			Expect(out[0].Attempts[0].Error).To(HaveOccurred())
+			Expect(out[0].Flaky()).To(BeTrue())
+			Expect(out[1].Error).To(HaveOccurred())
+			Expect(len(out[1].Attempts)).To(Equal(2))
+			Expect(out[1].Flaky()).To(BeFalse())
+		})
+
+		It("doesn't retry commands once the run is cancelled", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			begin := time.Now()
+			out, err := testrunner.Run(ctx, testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "retried", Run: "echo try >> tries; exit 1", Retries: 3, RetryDelay: "5s"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(len(out[0].Attempts)).To(Equal(1))
+			Expect(out[0].Interrupted).To(BeTrue())
+			Expect(time.Since(begin)).To(BeNumerically("<", 5*time.Second))
+
+			dat, err := ioutil.ReadFile(filepath.Join(testchart.RunnerDirectory(), "tries"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dat)).To(Equal("try\n"))
+		})
+
+		It("reruns failed commands at the end of the run", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				RerunFailed: 2,
+				Commands: []runner.Command{
+					{Name: "flaky", Run: "echo try >> tries; test $(wc -l < tries) -ge 2"},
+					{Name: "stable", Run: "echo stable >> stable"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Flaky()).To(BeTrue())
+			Expect(len(out[0].Attempts)).To(Equal(2))
+			Expect(len(out[1].Attempts)).To(Equal(1))
+
+			dat, err := ioutil.ReadFile(filepath.Join(testchart.RunnerDirectory(), "stable"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dat)).To(Equal("stable\n"))
+		})
+
+		It("doesn't rerun commands whose condition failed to evaluate", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				RerunFailed: 1,
+				Commands: []runner.Command{
+					{Name: "invalid", If: "index .Values.missing 1", Run: "touch invalid"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Error.Error()).To(ContainSubstring("while evaluating condition"))
+			Expect(out[0].Attempts).To(BeEmpty())
+			Expect(filepath.Join(testchart.RunnerDirectory(), "invalid")).ToNot(BeAnExistingFile())
+		})
+
+		It("stops at conditions failing to evaluate with fail fast", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				FailFast: true,
+				Commands: []runner.Command{
+					{Name: "invalid", If: "index .Values.missing 1", Run: "true"},
+					{Name: "test", Run: "echo test"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Failed()).To(BeTrue())
+			Expect(out[1].Skipped).To(BeTrue())
+			Expect(out[1].SkipReason).To(Equal("run stopped after 'invalid' failed"))
+		})
+
+		It("checks exit codes and output with expect", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{
+						Name: "negative",
+						Run:  "echo 'not found' >&2; exit 2",
+						Expect: runner.Expect{
+							ExitCodes: []int{1, 2},
+							Stderr:    runner.Match{Contains: []string{"not found"}},
+							Stdout:    runner.Match{NotMatches: []string{".+"}},
+						},
+					},
+					{
+						Name: "output",
+						Run:  "echo hello world",
+						Expect: runner.Expect{
+							Stdout: runner.Match{Contains: []string{"goodbye"}},
+						},
+					},
+					{
+						Name: "panic",
+						Run:  "echo starting; echo 'panic: oh no'",
+						Expect: runner.Expect{
+							FailOn: []string{"^panic:"},
+						},
+					},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Error).ToNot(HaveOccurred())
+			Expect(out[1].Error).To(HaveOccurred())
+			Expect(out[1].Error.Error()).To(ContainSubstring("stdout does not contain 'goodbye':\nhello world"))
+			Expect(out[2].Error).To(HaveOccurred())
+			Expect(out[2].Error.Error()).To(ContainSubstring("output matches '^panic:':\npanic: oh no"))
+		})
+
+		It("sets environment variables", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(testchart.RunnerDirectory(), "global.env"), []byte("# global\nGLOBAL=file\nOVERRIDE=file\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(testchart.RunnerDirectory(), "command.env"), []byte("export FROM_FILE=\"command file\"\n"), 0644)).To(Succeed())
+
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				EnvFiles: []string{"global.env"},
+				Env:      map[string]string{"OVERRIDE": "global"},
+				Commands: []runner.Command{
+					{
+						Name:     "env",
+						Run:      `echo "$GLOBAL $OVERRIDE $FROM_FILE $CHARTY_CHART_NAME $CHARTY_CHART_VERSION $CHARTY_COMMAND_NAME"`,
+						Env:      map[string]string{"OVERRIDE": "command"},
+						EnvFiles: []string{"command.env"},
+					},
+					{Name: "dir", Run: `test "$CHARTY_RUNNER_DIR" = "$PWD"`},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Output).To(Equal("file command command file foo bar env\n"))
+		})
+
+		It("runs commands in their working directory", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.MkdirAll(filepath.Join(testchart.RunnerDirectory(), "api"), os.ModePerm)).To(Succeed())
+
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "api", Dir: "api", Pre: "touch pre", Run: "pwd", Post: "touch post"},
+					{Name: "escape", Dir: "../", Run: "pwd"},
+					{Name: "allowed", Dir: "../", AllowExternalDir: true, Run: "true"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Error).ToNot(HaveOccurred())
+			Expect(out[0].Dir).To(Equal(filepath.Join(testchart.RunnerDirectory(), "api")))
+			Expect(filepath.Join(testchart.RunnerDirectory(), "api", "pre")).To(BeAnExistingFile())
+			Expect(filepath.Join(testchart.RunnerDirectory(), "api", "post")).To(BeAnExistingFile())
+			Expect(out[1].Error).To(HaveOccurred())
+			Expect(out[1].Error.Error()).To(ContainSubstring("outside of the runner directory"))
+			Expect(out[1].Output).To(BeEmpty())
+			Expect(out[2].Error).ToNot(HaveOccurred())
+		})
+
+		It("evaluates conditions against values, environment and results", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Env: map[string]string{"TARGET": "staging"},
+				Commands: []runner.Command{
+					{Name: "deploy", Run: "exit 1"},
+					{Name: "enabled", If: ".Values.bar", Run: "echo enabled"},
+					{Name: "disabled", If: `eq .Values.foo "nope"`, Run: "echo disabled"},
+					{Name: "diagnose", Needs: []string{"deploy"}, If: `failed("deploy")`, Run: "echo diagnose"},
+					{Name: "env", If: `eq .Env.TARGET "staging"`, Run: "echo env"},
+					{Name: "missing", If: ".Values.missing.key", Run: "echo missing"},
+					{Name: "invalid", If: ".Values.bar.key", Run: "echo invalid"},
+					{Name: "e2e", Needs: []string{"deploy"}, If: ".Values.bar", Run: "echo e2e"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[1].Output).To(Equal("enabled\n"))
+			Expect(out[2].Skipped).To(BeTrue())
+			Expect(out[2].SkipReason).To(ContainSubstring(`condition 'eq .Values.foo "nope"' is false`))
+			Expect(out[3].Output).To(Equal("diagnose\n"))
+			Expect(out[4].Output).To(Equal("env\n"))
+			Expect(out[5].Skipped).To(BeTrue())
+			Expect(out[6].Error).To(HaveOccurred())
+			// The condition doesn't look at deploy, which failed
+			Expect(out[7].Skipped).To(BeTrue())
+			Expect(out[7].SkipReason).To(Equal("needed command 'deploy' failed"))
+		})
+
+		It("stops at the first failure with fail fast", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				FailFast: true,
+				Commands: []runner.Command{
+					{Name: "check", Run: "exit 1", ContinueOnError: true},
+					{Name: "deploy", Run: "exit 1"},
+					{Name: "test", Run: "echo test"},
+				},
+				Post: []string{"touch post"},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Error).To(HaveOccurred())
+			Expect(out[0].Failed()).To(BeFalse())
+			Expect(out[1].Failed()).To(BeTrue())
+			Expect(out[2].Skipped).To(BeTrue())
+			Expect(out[2].SkipReason).To(Equal("run stopped after 'deploy' failed"))
+			Expect(filepath.Join(testchart.RunnerDirectory(), "post")).To(BeAnExistingFile())
+		})
+
+		It("stops the running commands at the first failure with fail fast", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			begin := time.Now()
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				FailFast: true,
+				Parallel: 2,
+				Commands: []runner.Command{
+					{Name: "slow", Run: "sleep 10"},
+					{Name: "deploy", Run: "sleep 0.2; exit 1"},
+					{Name: "test", Run: "echo test"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(begin)).To(BeNumerically("<", 5*time.Second))
+			Expect(out[0].Interrupted).To(BeTrue())
+			Expect(out[1].Failed()).To(BeTrue())
+			Expect(out[1].Interrupted).To(BeFalse())
+			Expect(out[2].Skipped).To(BeTrue())
+			Expect(out[2].SkipReason).To(Equal("run stopped after 'deploy' failed"))
+		})
+
+		It("does not fail the run for commands which continue on error", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "check", Run: "exit 1", ContinueOnError: true},
+					{Name: "test", Run: "echo test"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Error).To(HaveOccurred())
+		})
+
+		It("streams output to the configured sink", func() {
+			var stdout, stderr bytes.Buffer
+			testrunner.Output = &runner.PrefixSink{Out: &stdout, Err: &stderr}
+
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Pre: []string{"echo setup"},
+				Commands: []runner.Command{
+					{Name: "test", Run: "echo out; echo err >&2; printf partial"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Output).To(ContainSubstring("out\n"))
+			Expect(stdout.String()).To(Equal("[global-pre-run] setup\n[test] out\n[test] partial\n"))
+			Expect(stderr.String()).To(Equal("[test] err\n"))
+		})
+
+		It("stops commands and runs cleanup when cancelled", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(500*time.Millisecond, cancel)
+			out, err := testrunner.Run(ctx, testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "long", Run: "sleep 10"},
+					{Name: "next", Run: "echo next"},
+				},
+				Post: []string{"touch post"},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("run interrupted"))
+			Expect(out[0].Interrupted).To(BeTrue())
+			Expect(out[0].Elapsed).To(BeNumerically("<", 5))
+			Expect(out[1].Skipped).To(BeTrue())
+			Expect(out[1].SkipReason).To(Equal("run interrupted"))
+			Expect(filepath.Join(testchart.RunnerDirectory(), "post")).To(BeAnExistingFile())
+		})
+
+		It("expands matrix commands", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{
+						Name:   "test",
+						Matrix: map[string][]string{"db": {"pg", "mysql"}, "version": {"1", "2"}},
+						Run:    "echo {{ .Matrix.db }} $CHARTY_MATRIX_VERSION >> matrix",
+						Always: "echo always {{ .Matrix.db | upper }}",
+					},
+					{Name: "report", Needs: []string{"test"}, Run: "cat matrix"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(out)).To(Equal(5))
+			Expect(out[0].Command.Name).To(Equal("test[db=pg,version=1]"))
+			Expect(out[0].Command.MatrixValues).To(Equal(map[string]string{"db": "pg", "version": "1"}))
+			Expect(out[3].Command.Name).To(Equal("test[db=mysql,version=2]"))
+			Expect(out[4].Output).To(Equal("pg 1\npg 2\nmysql 1\nmysql 2\n"))
+			Expect(out[0].Always.Output).To(Equal("always PG\n"))
+			Expect(out[3].Always.Output).To(Equal("always MYSQL\n"))
+		})
+
+		It("rejects empty matrices and unknown matrix values", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "test", Matrix: map[string][]string{"db": {}}, Run: "echo {{ .Matrix.db }}"},
+				},
+			})
+			Expect(err).To(MatchError(ContainSubstring("matrix key 'db' of command 'test' has no values")))
+
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "test", Matrix: map[string][]string{"db": {"pg"}}, Run: "echo {{ .Matrix.version | upper }}"},
+				},
+			})
+			Expect(err).To(MatchError(ContainSubstring(`map has no entry for key "version"`)))
+
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "test", Run: "echo {{ .Matrix.db }}"},
+				},
+			})
+			Expect(err).To(MatchError(ContainSubstring("unknown matrix key 'db'")))
+		})
+
+		It("writes logs and collects artifacts of failed commands", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{
+						Name:      "e2e/api",
+						Pre:       "echo preparing",
+						Run:       "mkdir -p reports && echo report > reports/junit.xml && echo failing && exit 1",
+						Post:      "echo cleaning > cleanup.txt",
+						Artifacts: []string{"reports/*.xml", "*.txt", "missing/*"},
+					},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].LogFile).To(Equal(filepath.Join(testchart.RunnerDirectory(), ".charty", "logs", "e2e_api.log")))
+
+			dat, err := ioutil.ReadFile(out[0].LogFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dat)).To(MatchRegexp("(?s)pre: echo preparing\npreparing\n.*run: .*\nfailing\n.*post: echo cleaning"))
+
+			artifacts := runner.ArtifactsDirectory(testchart.RunnerDirectory(), "e2e/api")
+			Expect(out[0].Artifacts).To(ConsistOf(filepath.Join(artifacts, "reports", "junit.xml"), filepath.Join(artifacts, "cleanup.txt")))
+			Expect(filepath.Join(artifacts, "reports", "junit.xml")).To(BeAnExistingFile())
+
+			out, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "other", Run: "mkdir -p x sub && echo x > x/f.txt"},
+					{Name: "sub", Dir: "sub", Needs: []string{"other"}, Run: "true", Artifacts: []string{"../x/*.txt"}},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[1].FailedPhase).To(Equal("artifacts"))
+			Expect(out[1].Error.Error()).To(ContainSubstring("outside of the working directory"))
+			Expect(out[1].Artifacts).To(BeEmpty())
+			Expect(filepath.Join(testchart.RunnerDirectory(), ".charty", "artifacts", "x")).ToNot(BeADirectory())
+		})
+
+		It("runs commands and inline scripts with the given shell", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Shell: "bash -euo pipefail",
+				Commands: []runner.Command{
+					{Name: "pipefail", Run: "false | true"},
+					{Name: "sh", Shell: "sh", Run: "echo $0"},
+					{
+						Name:   "script",
+						Shell:  "sh -e",
+						Script: "echo {{ .Values.bar }}\nfor i in 1 2; do\n  echo $i\ndone\n",
+					},
+					{
+						Name:   "matrix",
+						Matrix: map[string][]string{"lang": {"sh"}},
+						Script: "echo {{ .Matrix.lang | upper }} {{ .Values.foo }}",
+					},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Error).To(HaveOccurred())
+			Expect(out[1].Output).To(Equal("sh\n"))
+			Expect(out[2].Output).To(Equal("test\n1\n2\n"))
+			Expect(out[3].Output).To(Equal("SH real\n"))
+		})
+
+		It("writes scripts with the extension the shell needs", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			// Prints the script it is given, as pwsh would run it
+			pwsh := filepath.Join(testchart.RunnerDirectory(), "bin", "pwsh")
+			Expect(os.MkdirAll(filepath.Dir(pwsh), os.ModePerm)).To(Succeed())
+			Expect(ioutil.WriteFile(pwsh, []byte("#!/bin/sh\necho \"$@\"\n"), 0755)).To(Succeed())
+
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "pwsh", Shell: pwsh + " -NoProfile", Script: "Write-Output hello"},
+					{Name: "sh", Shell: "sh", Script: "echo $0"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			script := filepath.Join(testchart.RunnerDirectory(), ".charty", "scripts", "pwsh.ps1")
+			Expect(out[0].Output).To(Equal("-NoProfile " + script + "\n"))
+			Expect(script).To(BeAnExistingFile())
+			Expect(out[1].Output).To(Equal(filepath.Join(testchart.RunnerDirectory(), ".charty", "scripts", "sh") + "\n"))
+		})
+
+		It("feeds stdin to the run process", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(filepath.Join(testchart.RunnerDirectory(), "input.txt"), []byte("from file\n"), 0644)).To(Succeed())
+
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "inline", Stdin: "{{ .Values.bar }}\nline\n", Run: "cat", Expect: runner.Expect{ExitCodes: []int{0}}},
+					{Name: "file", StdinFile: "input.txt", Pre: "cat", Run: "wc -l"},
+					{Name: "exitcode", Stdin: "3", Run: "read code; exit $code", Expect: runner.Expect{ExitCodes: []int{3}}},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Output).To(Equal("test\nline\n"))
+			Expect(out[1].PreOutput).To(BeEmpty())
+			Expect(out[1].Output).To(Equal("1\n"))
+		})
+
+		It("records the output of every phase", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "phases", Pre: "echo pre", Run: "echo out; echo err >&2; exit 3", Post: "echo post >&2"},
+					{Name: "signal", Run: "kill -TERM $$"},
+					{Name: "post", Run: "true", Post: "false"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Pre.Stdout).To(Equal("pre\n"))
+			Expect(out[0].Run.Stdout).To(Equal("out\n"))
+			Expect(out[0].Run.Stderr).To(Equal("err\n"))
+			Expect(out[0].Post.Stderr).To(Equal("post\n"))
+			Expect(out[0].ExitCode).To(Equal(3))
+			Expect(out[0].FailedPhase).To(Equal("run"))
+			Expect(out[0].Start).ToNot(BeZero())
+			Expect(out[0].Run.Start).ToNot(BeTemporally("<", out[0].Pre.End))
+			Expect(out[0].End).ToNot(BeTemporally("<", out[0].Post.End))
+			Expect(out[1].ExitCode).To(Equal(-1))
+			Expect(out[1].Signal).To(Equal("SIGTERM"))
+			Expect(out[1].Pre).To(BeNil())
+			Expect(out[2].FailedPhase).To(Equal("post"))
+		})
+
+		It("applies resource limits and records usage", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{Name: "limits", Limits: runner.Limits{Memory: "512m", OpenFiles: 64}, Run: "ulimit -v; ulimit -n"},
+					{Name: "filesize", Limits: runner.Limits{FileSize: "1k"}, Run: "head -c 4096 /dev/zero > big"},
+					{Name: "cpu", Limits: runner.Limits{CPUTime: "1"}, Run: "while :; do :; done"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Output).To(Equal("524288\n64\n"))
+			Expect(out[0].Usage.MaxRSS).To(BeNumerically(">", 0))
+			Expect(out[1].Error).To(HaveOccurred())
+			Expect(out[2].Signal).To(Or(Equal("SIGXCPU"), Equal("SIGKILL")))
+			Expect(out[2].Usage.CPUTime()).To(BeNumerically(">=", 900*time.Millisecond))
+
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{{Name: "invalid", Limits: runner.Limits{Memory: "lots"}, Run: "true"}},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("runs commands in a sandbox", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			shared, err := ioutil.TempDir("", "charty-shared")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(shared)
+
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{{Name: "custom", Executor: "custom", Run: "true"}},
+			})
+			Expect(err).To(MatchError(ContainSubstring("unknown executor 'custom'")))
+
+			testrunner.Executors = map[string]runner.Executor{"custom": runner.LocalExecutor{}}
+			defer func() { testrunner.Executors = nil }()
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Executor: "sandbox",
+				Sandbox:  runner.SandboxExecutor{ReadOnly: []string{shared}},
+				Commands: []runner.Command{
+					{Name: "write", Run: "echo sandboxed > out && cat out"},
+					{Name: "hidden", Run: "test -e /root || test -e /var", Expect: runner.Expect{ExitCodes: []int{1}}},
+					{Name: "usr", Run: "test -d /usr && touch /usr/charty", Expect: runner.Expect{ExitCodes: []int{1}}},
+					{Name: "shared", Run: "test -d " + shared + " && touch " + shared + "/charty", Expect: runner.Expect{ExitCodes: []int{1}}},
+					{Name: "tmp", Run: "touch /tmp/charty-sandboxed && ls /tmp/charty-sandboxed"},
+					{Name: "network", Sandbox: runner.SandboxExecutor{DisableNetwork: true}, Run: "grep -c : /proc/net/dev"},
+					{Name: "limits", Limits: runner.Limits{OpenFiles: 64}, Run: "ulimit -n"},
+					{Name: "local", Executor: "local", Run: "test -d /var"},
+					{Name: "custom", Executor: "custom", Run: "true"},
+				},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Output).To(Equal("sandboxed\n"))
+			Expect(filepath.Join(testchart.RunnerDirectory(), "out")).To(BeAnExistingFile())
+			Expect(filepath.Join(os.TempDir(), "charty-sandboxed")).ToNot(BeAnExistingFile())
+			Expect(out[5].Output).To(Equal("1\n"))
+			Expect(out[6].Output).To(Equal("64\n"))
+		})
+
+		It("runs the hooks of the commands", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Timeout: "1s",
+				Commands: []runner.Command{
+					{Name: "passed", Run: "true", OnSuccess: "echo success", OnFailure: "echo failure", Always: "echo always"},
+					{Name: "pre", Pre: "false", Run: "touch ran", Post: "echo post", OnSuccess: "echo success", OnFailure: "echo failure"},
+					{Name: "hook", Run: "true", Always: "exit 2"},
+					{Name: "hung", Run: "sleep 10", Always: "echo cleanup", Needs: []string{"passed", "pre", "hook"}, If: `and failed("pre") failed("hook")`},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].OnSuccess.Output).To(Equal("success\n"))
+			Expect(out[0].OnFailure).To(BeNil())
+			Expect(out[0].Always.Output).To(Equal("always\n"))
+
+			Expect(out[1].FailedPhase).To(Equal("pre"))
+			Expect(out[1].Run).To(BeNil())
+			Expect(filepath.Join(testchart.RunnerDirectory(), "ran")).ToNot(BeAnExistingFile())
+			Expect(out[1].PostOutput).To(Equal("post\n"))
+			Expect(out[1].OnSuccess).To(BeNil())
+			Expect(out[1].OnFailure.Output).To(Equal("failure\n"))
+
+			Expect(out[2].Error).To(HaveOccurred())
+			Expect(out[2].FailedPhase).To(Equal("always"))
+
+			Expect(out[3].TimedOut).To(BeTrue())
+			Expect(out[3].Always.Output).To(Equal("cleanup\n"))
+		})
+
+		It("runs the global hooks", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Pre:       []string{"false"},
+				Post:      []string{"touch post"},
+				OnSuccess: []string{"echo success"},
+				OnFailure: []string{"false", "echo diagnostics"},
+				Always:    []string{"touch always"},
+				Commands:  []runner.Command{{Name: "test", Run: "touch test"}},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out).To(HaveLen(4))
+			Expect(out[0].Command.Name).To(Equal("global-pre-run"))
+			Expect(out[1].Skipped).To(BeTrue())
+			Expect(out[2].Command.Name).To(Equal("global-on-failure"))
+			Expect(out[2].Output).To(Equal("diagnostics\n"))
+			Expect(out[2].Error).To(HaveOccurred())
+			Expect(out[3].Command.Name).To(Equal("global-always"))
+			Expect(filepath.Join(testchart.RunnerDirectory(), "test")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(testchart.RunnerDirectory(), "post")).ToNot(BeAnExistingFile())
+			Expect(filepath.Join(testchart.RunnerDirectory(), "always")).To(BeAnExistingFile())
+		})
+
+		It("passes outputs between commands", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{
+					{
+						Name:    "deploy",
+						Run:     "echo 'deployed at http://localhost:8080' && echo 'token=abc' > $CHARTY_OUTPUT",
+						Outputs: map[string]string{"url": `deployed at (\S+)`, "missing": `not (found)`},
+					},
+					{Name: "test", Needs: []string{"deploy"}, Run: "echo {{ .Steps.deploy.outputs.url }} $CHARTY_STEP_DEPLOY_TOKEN"},
+					{Name: "unknown", Needs: []string{"deploy"}, Run: "echo {{ .Steps.deploy.outputs.port }}"},
+					{Name: "piped", Needs: []string{"deploy"}, Run: "echo {{ .Steps.deploy.outputs.token | upper }}"},
+				},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Outputs).To(Equal(map[string]string{"url": "http://localhost:8080", "token": "abc"}))
+			Expect(out[1].Output).To(Equal("http://localhost:8080 abc\n"))
+			Expect(out[2].FailedPhase).To(Equal("setup"))
+			Expect(out[2].Error.Error()).To(ContainSubstring("no output 'port'"))
+			Expect(out[3].Output).To(Equal("ABC\n"))
+
+			_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: []runner.Command{{Name: "test", Run: "true", Outputs: map[string]string{"url": "http://"}}},
+			})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("runs only the commands affected by the changes", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			commands := []runner.Command{
+				{Name: "deploy", Run: "echo deploy"},
+				{Name: "test", Needs: []string{"deploy"}, Run: "bash test.sh"},
+				{Name: "report", Needs: []string{"test"}, Run: "echo report"},
+				{Name: "lint", Dir: "lint", Run: "bash lint.sh"},
+				{Name: "quoted", Run: `test -f "./test.sh"`},
+				{Name: "longer", Run: "echo mytest.sh test.shell"},
+			}
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: commands,
+				Changed:  []string{"test.sh"},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Skipped).To(BeFalse())
+			Expect(out[1].Output).To(Equal("Foo testreal\n"))
+			Expect(out[2].Skipped).To(BeFalse())
+			Expect(out[3].Skipped).To(BeTrue())
+			Expect(out[3].SkipReason).To(Equal("not affected by the changes"))
+			Expect(out[4].Skipped).To(BeFalse())
+			// Paths are matched as a whole, not as part of longer names
+			Expect(out[5].Skipped).To(BeTrue())
+
+			out, err = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: commands,
+				Changed:  []string{"lint/lint.sh"},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].Skipped).To(BeTrue())
+			Expect(out[3].Skipped).To(BeFalse())
+
+			// Changes no command refers to run all of them
+			out, _ = testrunner.Run(context.Background(), testchart, runner.Options{
+				Commands: commands,
+				Changed:  []string{"README.md"},
+			})
+			Expect(out[0].Skipped).To(BeFalse())
+			Expect(out[3].Skipped).To(BeFalse())
+		})
+
+		It("aggregates the results of repeated runs", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			runs := [][]runner.CommandOutput{}
+			for i := 0; i < 4; i++ {
+				out, _ := testrunner.Run(context.Background(), testchart, runner.Options{
+					Commands: []runner.Command{
+						{Name: "alternate", Run: "echo >> runs && test $(( $(wc -l < runs) % 2 )) = 0"},
+						{Name: "retried", Retries: 1, Run: "echo >> retries && test $(( $(wc -l < retries) % 2 )) = 0"},
+						{Name: "stable", Run: "true"},
+						{Name: "never", If: "false", Run: "true"},
+					},
+				})
+				runs = append(runs, out)
+			}
+
+			stats := runner.Stats(runs)
+			Expect(stats).To(HaveLen(4))
+			Expect(stats[0].Name).To(Equal("alternate"))
+			Expect(stats[0].Passed).To(Equal(2))
+			Expect(stats[0].Failed).To(Equal(2))
+			Expect(stats[0].Unstable()).To(BeTrue())
+			Expect(stats[0].PassRate()).To(Equal(0.5))
+			Expect(stats[0].Durations).To(HaveLen(4))
+			Expect(stats[1].Flaky).To(Equal(4))
+			Expect(stats[1].Unstable()).To(BeTrue())
+			Expect(stats[2].Passed).To(Equal(4))
+			Expect(stats[2].Unstable()).To(BeFalse())
+			Expect(stats[2].Percentile(0)).To(BeNumerically("<=", stats[2].Percentile(100)))
+			Expect(stats[3].Skipped).To(Equal(4))
+			Expect(stats[3].Durations).To(BeEmpty())
+		})
+
+		It("shuffles the commands with a seed", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			commands := []runner.Command{{Name: "first", Run: "echo first >> order"}}
+			for _, n := range []string{"a", "b", "c", "d", "e", "f"} {
+				commands = append(commands, runner.Command{Name: n, Needs: []string{"first"}, Run: "echo " + n + " >> order"})
+			}
+			order := func(o runner.Options) ([]runner.CommandOutput, string) {
+				path := filepath.Join(testchart.RunnerDirectory(), "order")
+				os.Remove(path)
+				o.Commands = commands
+				out, err := testrunner.Run(context.Background(), testchart, o)
+				Expect(err).ToNot(HaveOccurred())
+				dat, err := ioutil.ReadFile(path)
+				Expect(err).ToNot(HaveOccurred())
+				return out, string(dat)
+			}
+
+			out, unshuffled := order(runner.Options{})
+			Expect(out[0].ShuffleSeed).To(BeZero())
+			Expect(unshuffled).To(Equal("first\na\nb\nc\nd\ne\nf\n"))
+
+			out, shuffled := order(runner.Options{ShuffleSeed: 42})
+			Expect(out[0].ShuffleSeed).To(Equal(int64(42)))
+			Expect(shuffled).ToNot(Equal(unshuffled))
+			Expect(shuffled).To(HavePrefix("first\n"))
+			_, replayed := order(runner.Options{ShuffleSeed: 42})
+			Expect(replayed).To(Equal(shuffled))
+
+			out, _ = order(runner.Options{Shuffle: true})
+			Expect(out[0].ShuffleSeed).ToNot(BeZero())
+		})
+
+		It("filters commands by name and tags", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			commands := []runner.Command{
+				{Name: "deploy", Run: "true", Tags: []string{"setup"}},
+				{Name: "test-api", Run: "true", Needs: []string{"deploy"}, Tags: []string{"smoke"}},
+				{Name: "test-ui", Run: "true", Tags: []string{"smoke", "slow"}},
+				{Name: "lint", Run: "true"},
+			}
+
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{Commands: commands, Focus: "^test-"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Skipped).To(BeFalse())
+			Expect(out[1].Skipped).To(BeFalse())
+			Expect(out[2].Skipped).To(BeFalse())
+			Expect(out[3].Skipped).To(BeTrue())
+			Expect(out[3].SkipReason).To(ContainSubstring("doesn't match focus"))
+
+			out, err = testrunner.List(testchart, runner.Options{Commands: commands, Tags: []string{"smoke"}, ExcludeTags: []string{"slow"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Skipped).To(BeFalse())
+			Expect(out[1].Skipped).To(BeFalse())
+			Expect(out[2].SkipReason).To(ContainSubstring("matches excluded tags 'slow'"))
+			Expect(out[3].SkipReason).To(ContainSubstring("matches none of the tags"))
+			for _, r := range out {
+				Expect(r.Testrun).To(BeFalse())
+			}
+
+			// Excluded commands are not run even if needed
+			out, err = testrunner.Run(context.Background(), testchart, runner.Options{Commands: commands, Skip: "deploy|lint"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].SkipReason).To(ContainSubstring("matches skip"))
+			Expect(out[1].SkipReason).To(Equal("needed command 'deploy' was not run"))
+			Expect(out[2].Skipped).To(BeFalse())
+
+			// Tags joined by + must all match, ! negates a tag
+			out, err = testrunner.List(testchart, runner.Options{Commands: commands, Tags: []string{"smoke+slow", "setup+!smoke"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[0].Skipped).To(BeFalse())
+			Expect(out[1].Skipped).To(BeTrue())
+			Expect(out[2].Skipped).To(BeFalse())
+			Expect(out[3].Skipped).To(BeTrue())
+
+			_, err = testrunner.List(testchart, runner.Options{Commands: commands, Focus: "("})
+			Expect(err).To(HaveOccurred())
+			_, err = testrunner.List(testchart, runner.Options{Commands: commands, Tags: []string{"smoke+"}})
+			Expect(err).To(MatchError(ContainSubstring("invalid tag expression 'smoke+'")))
+		})
+
+		It("renders the commands of the runtime file once", func() {
+			err := testchart.Load(context.Background(), "../../test/runtime")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{Focus: "^escaped$"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(out[2].Command.Name).To(Equal("escaped"))
+			Expect(out[2].Output).To(Equal("{{.ID}} false\n{{ .Values.e2e }}"))
+		})
+
+		It("stops the run at the global timeout", func() {
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+				Timeout: "500ms",
+				Commands: []runner.Command{
+					{Name: "hung", Run: "sleep 10"},
+					{Name: "next", Run: "echo next"},
+				},
+				Post: []string{"touch post"},
+			})
+			Expect(err).To(HaveOccurred())
+			Expect(out[0].TimedOut).To(BeTrue())
+			Expect(out[1].Skipped).To(BeTrue())
+			Expect(filepath.Join(testchart.RunnerDirectory(), "post")).To(BeAnExistingFile())
+		})
 	})
 })
@@ -0,0 +1,54 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SandboxExecutor runs processes in unprivileged user and mount
+// namespaces, where only the runner directory is writable and the rest of
+// the host is hidden, besides SandboxPaths and ReadOnly. It's only
+// supported on Linux.
+type SandboxExecutor struct {
+	// ReadOnly are absolute host paths visible in the sandbox
+	ReadOnly []string `yaml:"readOnly"`
+	// DisableNetwork runs the processes in a network namespace with only
+	// the loopback interface
+	DisableNetwork bool `yaml:"disableNetwork"`
+}
+
+// SandboxPaths are the host paths visible read-only in every sandbox, the
+// missing ones are ignored. /dev and /proc are visible as well, and /tmp is
+// an empty temporary filesystem.
+var SandboxPaths = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64", "/etc"}
+
+// merge returns the sandbox options of a command, given the global ones
+func (s SandboxExecutor) merge(o SandboxExecutor) SandboxExecutor {
+	return SandboxExecutor{
+		ReadOnly:       append(append([]string{}, s.ReadOnly...), o.ReadOnly...),
+		DisableNetwork: s.DisableNetwork || o.DisableNetwork,
+	}
+}
+
+func (s SandboxExecutor) validate() error {
+	for _, p := range s.ReadOnly {
+		if !filepath.IsAbs(p) {
+			return errors.Errorf("read-only sandbox path '%s' is not absolute", p)
+		}
+	}
+	return nil
+}
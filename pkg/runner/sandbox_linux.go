@@ -0,0 +1,252 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// From linux/securebits.h
+const (
+	secbitNoRoot       = 1 << 0
+	secbitNoRootLocked = 1 << 1
+)
+
+// sandbox describes the filesystem of a sandbox, Root is where it is
+// mounted
+type sandbox struct {
+	Root     string
+	ReadOnly []string
+	Writable []string
+	Dir      string
+	Loopback bool
+}
+
+func (s SandboxExecutor) Run(ctx context.Context, p Process) (PhaseOutput, error) {
+	root, err := ioutil.TempDir("", "charty-sandbox")
+	if err != nil {
+		err = errors.Wrap(err, "while creating the sandbox root")
+		return PhaseOutput{Command: p.Command, ExitCode: -1, Error: err}, err
+	}
+	// The mounts are gone with the mount namespace
+	defer os.Remove(root)
+
+	box := sandbox{
+		Root:     root,
+		ReadOnly: append(append([]string{}, SandboxPaths...), s.ReadOnly...),
+		Writable: []string{p.RunnerDir},
+		Dir:      p.Dir,
+		Loopback: s.DisableNetwork,
+	}
+	if !strings.HasPrefix(p.Dir+"/", p.RunnerDir+"/") {
+		// Directories outside of the runner one are allowed explicitly
+		box.Writable = append(box.Writable, p.Dir)
+	}
+
+	return runProc(ctx, p, func(cmd *exec.Cmd) error {
+		if err := reexec(cmd, func(i *processInit) { i.Sandbox = &box }); err != nil {
+			return err
+		}
+
+		attr := cmd.SysProcAttr
+		if attr == nil {
+			attr = &syscall.SysProcAttr{}
+			cmd.SysProcAttr = attr
+		}
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+		if s.DisableNetwork {
+			attr.Cloneflags |= syscall.CLONE_NEWNET
+		}
+		// The processes keep the current user and group. The capabilities
+		// needed to set up the sandbox are dropped before executing the
+		// shell.
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+		attr.AmbientCaps = []uintptr{unix.CAP_SYS_ADMIN, unix.CAP_SYS_CHROOT, unix.CAP_SETPCAP, unix.CAP_NET_ADMIN}
+		return nil
+	})
+}
+
+// setup mounts the filesystem of the sandbox and changes root to it. It
+// runs in the namespaces of the sandbox.
+func (s sandbox) setup() error {
+	if err := s.mount(); err != nil {
+		return err
+	}
+	if s.Loopback {
+		if err := loopbackUp(); err != nil {
+			return errors.Wrap(err, "while setting up the loopback interface")
+		}
+	}
+	return nil
+}
+
+// dropCapabilities drops the capabilities used to set up the sandbox,
+// without regaining them on exec if running as root, and doesn't let the
+// process gain any.
+func dropCapabilities() error {
+	if err := unix.Prctl(unix.PR_SET_SECUREBITS, secbitNoRoot|secbitNoRootLocked, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "while setting securebits")
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.Wrap(err, "while setting no_new_privs")
+	}
+	caps := [2]unix.CapUserData{}
+	if err := unix.Capset(&unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}, &caps[0]); err != nil {
+		return errors.Wrap(err, "while dropping capabilities")
+	}
+	return nil
+}
+
+func (s sandbox) mount() error {
+	// Keep the mounts out of the host
+	if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+		return errors.Wrap(err, "while making mounts private")
+	}
+	if err := unix.Mount("tmpfs", s.Root, "tmpfs", 0, "mode=0755"); err != nil {
+		return errors.Wrap(err, "while mounting the sandbox root")
+	}
+
+	// Paths under /tmp are mounted over it
+	tmp := filepath.Join(s.Root, "tmp")
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := unix.Mount("tmpfs", tmp, "tmpfs", 0, "mode=1777"); err != nil {
+		return errors.Wrap(err, "while mounting /tmp")
+	}
+	for _, p := range s.ReadOnly {
+		if err := s.bind(p, true); err != nil {
+			return err
+		}
+	}
+	for _, p := range []string{"/dev", "/proc"} {
+		if err := s.bind(p, false); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.Writable {
+		if err := s.bind(p, false); err != nil {
+			return err
+		}
+	}
+
+	if err := unix.Chroot(s.Root); err != nil {
+		return errors.Wrap(err, "while changing root")
+	}
+	return errors.Wrap(os.Chdir(s.Dir), "while changing directory")
+}
+
+// bind makes a host path visible at the same path in the sandbox, missing
+// paths are ignored
+func (s sandbox) bind(path string, readOnly bool) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(s.Root, path)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case fi.IsDir():
+		err = os.MkdirAll(dst, 0755)
+	default:
+		err = ioutil.WriteFile(dst, nil, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := unix.Mount(path, dst, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+		return errors.Wrapf(err, "while mounting '%s'", path)
+	}
+	if !readOnly {
+		return nil
+	}
+	// The flags of the host mount can't be cleared in a user namespace
+	flags, err := mountFlags(dst)
+	if err != nil {
+		return err
+	}
+	if err := unix.Mount("", dst, "", flags|unix.MS_REMOUNT|unix.MS_BIND|unix.MS_RDONLY, ""); err != nil {
+		return errors.Wrapf(err, "while mounting '%s' read-only", path)
+	}
+	return nil
+}
+
+func mountFlags(path string) (uintptr, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	var flags uintptr
+	for statFlag, mountFlag := range map[int64]uintptr{
+		unix.ST_NOSUID:     unix.MS_NOSUID,
+		unix.ST_NODEV:      unix.MS_NODEV,
+		unix.ST_NOEXEC:     unix.MS_NOEXEC,
+		unix.ST_NOATIME:    unix.MS_NOATIME,
+		unix.ST_NODIRATIME: unix.MS_NODIRATIME,
+		unix.ST_RELATIME:   unix.MS_RELATIME,
+	} {
+		if int64(st.Flags)&statFlag != 0 {
+			flags |= mountFlag
+		}
+	}
+	return flags, nil
+}
+
+// loopbackUp brings up the loopback interface of a new network namespace
+func loopbackUp() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	var ifr struct {
+		name  [unix.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= unix.IFF_UP | unix.IFF_RUNNING
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
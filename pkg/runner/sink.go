@@ -0,0 +1,112 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// OutputSink provides the writers where the output of a command is
+// streamed while it runs. The output is captured in CommandOutput
+// regardless of the sink.
+type OutputSink interface {
+	Stdout(c Command) io.Writer
+	Stderr(c Command) io.Writer
+}
+
+// WriterSink streams the output of all the commands to the same writers.
+type WriterSink struct {
+	Out, Err io.Writer
+}
+
+func (s WriterSink) Stdout(c Command) io.Writer { return s.Out }
+func (s WriterSink) Stderr(c Command) io.Writer { return s.Err }
+
+// StdSink streams output to the stdout and stderr of the current process.
+var StdSink = WriterSink{Out: os.Stdout, Err: os.Stderr}
+
+// DiscardSink silences the output of the commands.
+var DiscardSink = WriterSink{Out: ioutil.Discard, Err: ioutil.Discard}
+
+// PrefixSink streams output to the writers, with every line prefixed by
+// the name of the command it comes from.
+type PrefixSink struct {
+	Out, Err io.Writer
+
+	mu sync.Mutex
+}
+
+func (s *PrefixSink) Stdout(c Command) io.Writer {
+	return &prefixWriter{mu: &s.mu, w: s.Out, prefix: []byte("[" + c.Name + "] ")}
+}
+
+func (s *PrefixSink) Stderr(c Command) io.Writer {
+	return &prefixWriter{mu: &s.mu, w: s.Err, prefix: []byte("[" + c.Name + "] ")}
+}
+
+// prefixWriter writes complete lines with a prefix, the lock is shared
+// between writers to keep lines of concurrent commands from mixing up.
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			return len(b), nil
+		}
+		if err := p.write(p.buf[:i+1]); err != nil {
+			return len(b), err
+		}
+		p.buf = p.buf[i+1:]
+	}
+}
+
+func (p *prefixWriter) write(line []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
+
+// Flush writes what is left of the last line.
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+	err := p.write(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+type flusher interface {
+	Flush() error
+}
+
+func flush(writers ...io.Writer) {
+	for _, w := range writers {
+		if f, ok := w.(flusher); ok {
+			f.Flush()
+		}
+	}
+}
@@ -0,0 +1,467 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHOptions are the options of the ssh executor.
+type SSHOptions struct {
+	// Host is the address of the host, with an optional port
+	Host string `yaml:"host"`
+	User string `yaml:"user"`
+	// Key is the path of the private key to authenticate with
+	Key string `yaml:"key"`
+	// KnownHosts is the file used to verify the host key,
+	// ~/.ssh/known_hosts by default
+	KnownHosts            string `yaml:"knownHosts"`
+	InsecureIgnoreHostKey bool   `yaml:"insecureIgnoreHostKey"`
+	// Dir is where the runner directory is copied to on the host, a
+	// temporary directory removed after the run by default
+	Dir string `yaml:"dir"`
+}
+
+// SSHExecutor runs processes on a remote host. The runner directory is
+// copied to the host before the first process runs, and processes run in
+// the copy. Resource limits are not supported.
+type SSHExecutor struct {
+	Options SSHOptions
+
+	mu        sync.Mutex
+	client    *ssh.Client
+	dir       string
+	temporary bool
+	// sequence names the files of the processes on the host
+	sequence uint64
+}
+
+// NewSSHExecutor returns an executor for the host, which connects to it
+// when the first process runs.
+func NewSSHExecutor(o SSHOptions) *SSHExecutor {
+	return &SSHExecutor{Options: o}
+}
+
+func (o SSHOptions) validate() error {
+	if len(o.Host) == 0 {
+		return errors.New("no host set for the ssh executor")
+	}
+	if len(o.Key) == 0 {
+		return errors.New("no key set for the ssh executor")
+	}
+	return nil
+}
+
+func (o SSHOptions) clientConfig() (*ssh.ClientConfig, error) {
+	key, err := ioutil.ReadFile(expandHome(o.Key))
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading the ssh key")
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "while parsing the ssh key")
+	}
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if !o.InsecureIgnoreHostKey {
+		knownHosts := o.KnownHosts
+		if len(knownHosts) == 0 {
+			knownHosts = "~/.ssh/known_hosts"
+		}
+		if hostKey, err = knownhosts.New(expandHome(knownHosts)); err != nil {
+			return nil, errors.Wrap(err, "while reading known hosts")
+		}
+	}
+
+	user := o.User
+	if len(user) == 0 {
+		user = os.Getenv("USER")
+	}
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKey,
+		Timeout:         30 * time.Second,
+	}, nil
+}
+
+// expandHome replaces a leading ~ with the home directory
+func expandHome(p string) string {
+	if p != "~" && !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[1:])
+}
+
+// connect connects to the host and copies the runner directory the first
+// time it's called.
+func (e *SSHExecutor) connect(ctx context.Context, runnerDir string) (*ssh.Client, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.client != nil {
+		return e.client, e.dir, nil
+	}
+
+	config, err := e.Options.clientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	addr := e.Options.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "while connecting to "+addr)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, "", errors.Wrap(err, "while connecting to "+addr)
+	}
+	client := ssh.NewClient(c, chans, reqs)
+
+	dir, temporary := e.Options.Dir, false
+	if len(dir) == 0 {
+		out, err := remoteOutput(client, "mktemp -d", nil)
+		if err != nil {
+			client.Close()
+			return nil, "", errors.Wrap(err, "while creating the remote directory")
+		}
+		dir, temporary = strings.TrimSpace(out), true
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeTar(w, runnerDir))
+	}()
+	_, err = remoteOutput(client, fmt.Sprintf("mkdir -p %s && tar -xf - -C %s", quote(dir), quote(dir)), r)
+	r.Close()
+	if err != nil {
+		client.Close()
+		return nil, "", errors.Wrap(err, "while copying the runner directory")
+	}
+
+	e.client, e.dir, e.temporary = client, dir, temporary
+	return client, dir, nil
+}
+
+// Close removes the temporary directory on the host, and disconnects.
+func (e *SSHExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.client == nil {
+		return nil
+	}
+
+	var err error
+	if e.temporary {
+		_, err = remoteOutput(e.client, "rm -rf "+quote(e.dir), nil)
+	}
+	if cerr := e.client.Close(); err == nil {
+		err = cerr
+	}
+	e.client = nil
+	return err
+}
+
+func (e *SSHExecutor) Run(ctx context.Context, p Process) (PhaseOutput, error) {
+	fail := func(err error) (PhaseOutput, error) {
+		return PhaseOutput{Command: p.Command, ExitCode: -1, Error: err}, err
+	}
+	if !p.Limits.empty() {
+		return fail(errors.New("resource limits are not supported by the ssh executor"))
+	}
+
+	client, dir, err := e.connect(ctx, p.RunnerDir)
+	if err != nil {
+		return fail(err)
+	}
+	id := fmt.Sprint(atomic.AddUint64(&e.sequence, 1))
+	cmd, err := remoteCommand(client, p, dir, id)
+	if err != nil {
+		return fail(err)
+	}
+	pgid := remoteProcessFile(dir, id, "pgid")
+	defer remoteOutput(client, "rm -f "+quote(pgid), nil)
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fail(errors.Wrap(err, "while opening an ssh session"))
+	}
+	defer session.Close()
+
+	c := newCapture(p)
+	session.Stdout, session.Stderr = c.writers()
+	session.Stdin = p.Stdin
+	if err := session.Start(cmd); err != nil {
+		return c.output(err), err
+	}
+
+	// The process group is signalled, so the children of the shell are
+	// stopped as well
+	var signalled syscall.Signal
+	err, stopped := supervise(ctx, p, c.all, session.Wait, func(sig syscall.Signal) {
+		signalled = sig
+		name := strings.TrimPrefix(signalName(sig), "SIG")
+		if _, err := remoteOutput(client, fmt.Sprintf("kill -s %s -- -$(cat %s)", name, quote(pgid)), nil); err != nil {
+			session.Signal(ssh.Signal(name))
+		}
+		if sig == syscall.SIGKILL {
+			session.Close()
+		}
+	})
+	if stopped == nil {
+		if res := downloadOutput(client, p, dir); res != nil && err == nil {
+			err = errors.Wrap(res, "while copying back the output file")
+		}
+	}
+	out := c.output(err)
+	switch exit := err.(type) {
+	case nil:
+		out.ExitCode = 0
+	case *ssh.ExitError:
+		if len(exit.Signal()) > 0 {
+			out.Signal = "SIG" + exit.Signal()
+		} else if signalled != 0 && exit.ExitStatus() == 128+int(signalled) {
+			// setsid reports the signal of the process as an exit status
+			out.Signal = signalName(signalled)
+		} else {
+			out.ExitCode = exit.ExitStatus()
+		}
+	}
+	if stopped != nil {
+		out.Error = stopped
+		return out, stopped
+	}
+	return out, err
+}
+
+// remoteCommand returns the command line which runs the process on the
+// host, where dir is the copy of the runner directory. Scripts are copied
+// as they are written after the runner directory was. The process runs in
+// a new session, whose id is written to the pgid file of the process, and
+// the environment is given in a file, read and removed before the process
+// starts, so it doesn't show in the arguments.
+func remoteCommand(client *ssh.Client, p Process, dir, id string) (string, error) {
+	workdir, err := remotePath(p.RunnerDir, p.Dir, dir)
+	if err != nil {
+		return "", err
+	}
+
+	args := p.args()
+	if p.File {
+		script, err := remotePath(p.RunnerDir, p.Command, dir)
+		if err != nil {
+			return "", err
+		}
+		f, err := os.Open(p.Command)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		if err := upload(client, f, script, 0755); err != nil {
+			return "", errors.Wrap(err, "while copying the script")
+		}
+		args[len(args)-1] = script
+	}
+
+	var env strings.Builder
+	for _, e := range p.Env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !shellName.MatchString(kv[0]) {
+			return "", errors.Errorf("environment variable '%s' can't be set on the host", kv[0])
+		}
+		switch kv[0] {
+		case "CHARTY_RUNNER_DIR":
+			kv[1] = dir
+		case "CHARTY_OUTPUT":
+			// The output file is copied back by Run
+			output, err := remotePath(p.RunnerDir, kv[1], dir)
+			if err != nil {
+				return "", err
+			}
+			f, err := os.Open(kv[1])
+			if err != nil {
+				return "", err
+			}
+			err = upload(client, f, output, 0644)
+			f.Close()
+			if err != nil {
+				return "", errors.Wrap(err, "while copying the output file")
+			}
+			kv[1] = output
+		}
+		fmt.Fprintf(&env, "export %s=%s\n", kv[0], quote(kv[1]))
+	}
+	envFile := remoteProcessFile(dir, id, "env")
+	if err := upload(client, strings.NewReader(env.String()), envFile, 0600); err != nil {
+		return "", errors.Wrap(err, "while copying the environment")
+	}
+
+	// The shell outlives the signals sent to the group, so the status of
+	// the process is returned rather than the one of setsid
+	script := fmt.Sprintf(`echo $$ > %s && . %s && rm -f %s && cd %s || exit; trap : TERM INT; "$@"`,
+		quote(remoteProcessFile(dir, id, "pgid")), quote(envFile), quote(envFile), quote(workdir))
+	words := []string{"exec", "setsid", "-w", "sh", "-c", quote(script), "sh"}
+	for _, a := range args {
+		words = append(words, quote(a))
+	}
+	return strings.Join(words, " "), nil
+}
+
+// shellName matches the names of the variables a shell can export
+var shellName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// remoteProcessFile returns the path on the host of a file of a process
+func remoteProcessFile(dir, id, kind string) string {
+	return path.Join(dir, ChartyDirectory, "processes", id+"."+kind)
+}
+
+// upload copies content to a file on the host, created with the given
+// mode
+func upload(client *ssh.Client, content io.Reader, remote string, mode os.FileMode) error {
+	_, err := remoteOutput(client, fmt.Sprintf("mkdir -p %s && (umask 077 && cat > %s) && chmod %o %s", quote(path.Dir(remote)), quote(remote), mode, quote(remote)), content)
+	return err
+}
+
+// downloadOutput copies back the output file of the process, if it has
+// one
+func downloadOutput(client *ssh.Client, p Process, dir string) error {
+	for _, e := range p.Env {
+		local := strings.TrimPrefix(e, "CHARTY_OUTPUT=")
+		if local == e {
+			continue
+		}
+		output, err := remotePath(p.RunnerDir, local, dir)
+		if err != nil {
+			return err
+		}
+		session, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		dat, err := session.Output("cat " + quote(output))
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(local, dat, 0644)
+	}
+	return nil
+}
+
+// remotePath returns the path on the host of a path in the runner
+// directory.
+func remotePath(runnerDir, p, dir string) (string, error) {
+	// The working directory has symlinks resolved
+	if resolved, err := filepath.EvalSymlinks(runnerDir); err == nil {
+		runnerDir = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		p = resolved
+	}
+	rel, err := filepath.Rel(runnerDir, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", errors.Errorf("'%s' is outside of the runner directory, which is the only one copied to the host", p)
+	}
+	return path.Join(dir, filepath.ToSlash(rel)), nil
+}
+
+// remoteOutput runs a command on the host, and returns its output
+func remoteOutput(client *ssh.Client, cmd string, stdin io.Reader) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	session.Stdin = stdin
+	out, err := session.CombinedOutput(cmd)
+	if err != nil {
+		return string(out), errors.Wrap(err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// quote quotes a string for a POSIX shell
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+// writeTar writes an archive with the content of the directory
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
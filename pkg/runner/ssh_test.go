@@ -0,0 +1,236 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	runner "github.com/mudler/charty/pkg/runner"
+	test "github.com/mudler/charty/pkg/testchart"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/sys/unix"
+)
+
+// sshServer is a minimal server running exec requests with sh, as sshd
+// would. It returns its address and host key.
+func sshServer(authorized ssh.PublicKey) (string, ssh.PublicKey, func()) {
+	hostKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	Expect(err).ToNot(HaveOccurred())
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, errors.New("unauthorized")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for c := range chans {
+					go serveSession(c)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), signer.PublicKey(), func() { l.Close() }
+}
+
+func serveSession(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	var cmd *exec.Cmd
+	exited := make(chan struct{})
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			cmd = exec.Command("/bin/sh", "-c", payload.Command)
+			// sshd starts commands in a new session
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = channel, channel, channel.Stderr()
+			req.Reply(cmd.Start() == nil, nil)
+			go func() {
+				defer close(exited)
+				cmd.Wait()
+				status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+				if status.Signaled() {
+					channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+						Signal     string
+						CoreDumped bool
+						Error      string
+						Lang       string
+					}{Signal: strings.TrimPrefix(unix.SignalName(status.Signal()), "SIG")}))
+				} else {
+					channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status.ExitStatus())}))
+				}
+				channel.Close()
+			}()
+		case "signal":
+			var payload struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &payload)
+			if cmd != nil && payload.Signal == "TERM" {
+				cmd.Process.Signal(syscall.SIGTERM)
+			} else if cmd != nil {
+				cmd.Process.Kill()
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+	if cmd != nil {
+		<-exited
+	}
+}
+
+var _ = Describe("SSH executor", func() {
+	var testchart *test.TestChart
+	var addr, keyFile, knownHosts string
+	var stop func()
+
+	BeforeEach(func() {
+		testchart = &test.TestChart{Values: map[string]interface{}{"bar": "test"}}
+		Expect(testchart.Load(context.Background(), "../../test/fixture")).To(Succeed())
+
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).ToNot(HaveOccurred())
+		public, err := ssh.NewPublicKey(&key.PublicKey)
+		Expect(err).ToNot(HaveOccurred())
+		keyFile = filepath.Join(testchart.RunnerDirectory(), "..", filepath.Base(testchart.RunnerDirectory())+".key")
+		Expect(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)).To(Succeed())
+
+		var hostKey ssh.PublicKey
+		addr, hostKey, stop = sshServer(public)
+		knownHosts = keyFile + ".known_hosts"
+		Expect(ioutil.WriteFile(knownHosts, []byte(knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey)+"\n"), 0600)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		stop()
+		os.Remove(keyFile)
+		os.Remove(knownHosts)
+		testchart.Cleanup()
+	})
+
+	It("runs commands on the host", func() {
+		Expect(ioutil.WriteFile(filepath.Join(testchart.RunnerDirectory(), "input.txt"), []byte("copied\n"), 0644)).To(Succeed())
+		child := filepath.Join(testchart.RunnerDirectory(), "child.pid")
+
+		testrunner := &runner.TestRunner{}
+		out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+			Executor: "ssh",
+			SSH: runner.SSHOptions{
+				Host:       addr,
+				Key:        keyFile,
+				KnownHosts: knownHosts,
+			},
+			Commands: []runner.Command{
+				{Name: "copy", Run: "cat input.txt && pwd && echo $CHARTY_RUNNER_DIR"},
+				{Name: "env", Env: map[string]string{"QUOTED": "it's"}, Run: `echo "$QUOTED"; echo "quoted=$QUOTED" > $CHARTY_OUTPUT`},
+				{Name: "script", Shell: "sh", Script: "echo {{ .Values.bar }}"},
+				{Name: "fail", Run: "echo failed >&2; exit 3", ContinueOnError: true},
+				{Name: "timeout", Timeout: "500ms", Run: "sleep 10 & echo $! > " + child + "; wait", ContinueOnError: true},
+				{Name: "local", Executor: "local", Run: "pwd"},
+				{Name: "args", Env: map[string]string{"SECRET": "hidden"}, Run: `echo "$SECRET"; tr '\0' ' ' < /proc/$PPID/cmdline`},
+			},
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		lines := strings.Split(out[0].Output, "\n")
+		Expect(lines[0]).To(Equal("copied"))
+		Expect(lines[1]).ToNot(Equal(testchart.RunnerDirectory()))
+		Expect(lines[2]).To(Equal(lines[1]))
+		// The temporary directory is removed after the run
+		Expect(lines[1]).ToNot(BeADirectory())
+
+		Expect(out[1].Output).To(Equal("it's\n"))
+		Expect(out[1].Outputs).To(Equal(map[string]string{"quoted": "it's"}))
+		Expect(out[2].Output).To(Equal("test\n"))
+		Expect(out[3].ExitCode).To(Equal(3))
+		Expect(out[3].Run.Stderr).To(Equal("failed\n"))
+		Expect(out[4].TimedOut).To(BeTrue())
+		Expect(out[4].Signal).To(Equal("SIGTERM"))
+		// The children of the command are stopped with it
+		pid, err := ioutil.ReadFile(child)
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(func() string {
+			stat, _ := ioutil.ReadFile("/proc/" + strings.TrimSpace(string(pid)) + "/stat")
+			return string(stat)
+		}).Should(Or(BeEmpty(), ContainSubstring(") Z ")))
+		Expect(out[5].Output).To(Equal(testchart.RunnerDirectory() + "\n"))
+
+		// The environment isn't in the arguments of the processes
+		lines = strings.SplitN(out[6].Output, "\n", 2)
+		Expect(lines[0]).To(Equal("hidden"))
+		Expect(lines[1]).To(ContainSubstring(`echo "$SECRET"`))
+		Expect(lines[1]).ToNot(ContainSubstring("hidden"))
+	})
+
+	It("fails to connect to unknown hosts", func() {
+		Expect(ioutil.WriteFile(knownHosts, nil, 0600)).To(Succeed())
+
+		testrunner := &runner.TestRunner{}
+		out, err := testrunner.Run(context.Background(), testchart, runner.Options{
+			Executor: "ssh",
+			SSH:      runner.SSHOptions{Host: addr, Key: keyFile, KnownHosts: knownHosts},
+			Commands: []runner.Command{{Name: "unknown", Run: "true"}},
+		})
+		Expect(err).To(HaveOccurred())
+		Expect(out[0].Error.Error()).To(ContainSubstring("key is unknown"))
+
+		_, err = testrunner.Run(context.Background(), testchart, runner.Options{
+			Executor: "ssh",
+			Commands: []runner.Command{{Name: "nohost", Run: "true"}},
+		})
+		Expect(err).To(MatchError(ContainSubstring("no host set for the ssh executor")))
+	})
+})
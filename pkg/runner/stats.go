@@ -0,0 +1,109 @@
+/*
+Copyright Ettore Di Giacinto <mudler@gentoo.org>.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package runner
+
+import (
+	"math"
+	"sort"
+)
+
+// CommandStats are the results of a command over repeated runs of a chart
+type CommandStats struct {
+	Name string
+	// Runs is the number of runs which had the command. Passed, Flaky,
+	// Failed and Skipped add up to it, Flaky are the runs where the
+	// command passed only after being retried.
+	Runs, Passed, Flaky, Failed, Skipped int
+	// Durations are the ones of the runs where the command ran, in
+	// seconds
+	Durations []float64
+}
+
+// Unstable reports whether the command didn't have the same outcome in
+// all the runs.
+func (s CommandStats) Unstable() bool {
+	return s.Flaky > 0 || (s.Passed > 0 && s.Failed > 0)
+}
+
+// PassRate is the fraction of the runs where the command passed, at the
+// first attempt or after retries.
+func (s CommandStats) PassRate() float64 {
+	if s.Runs == s.Skipped {
+		return 0
+	}
+	return float64(s.Passed+s.Flaky) / float64(s.Runs-s.Skipped)
+}
+
+// Percentile returns the duration, in seconds, below which is the given
+// percentage of the durations.
+func (s CommandStats) Percentile(p float64) float64 {
+	if len(s.Durations) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, s.Durations...)
+	sort.Float64s(sorted)
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// Mean returns the average duration, in seconds
+func (s CommandStats) Mean() float64 {
+	if len(s.Durations) == 0 {
+		return 0
+	}
+	total := 0.0
+	for _, d := range s.Durations {
+		total += d
+	}
+	return total / float64(len(s.Durations))
+}
+
+// Stats returns the results of every command over the given runs, in the
+// order the commands first appear. The global commands are left out.
+func Stats(runs [][]CommandOutput) []CommandStats {
+	res := []CommandStats{}
+	index := map[string]int{}
+	for _, run := range runs {
+		for _, r := range run {
+			if !r.Testrun && !r.Skipped {
+				continue
+			}
+			i, ok := index[r.Command.Name]
+			if !ok {
+				i = len(res)
+				index[r.Command.Name] = i
+				res = append(res, CommandStats{Name: r.Command.Name})
+			}
+
+			s := &res[i]
+			s.Runs++
+			switch {
+			case r.Skipped:
+				s.Skipped++
+				continue
+			case r.Flaky():
+				s.Flaky++
+			case r.Error != nil:
+				s.Failed++
+			default:
+				s.Passed++
+			}
+			s.Durations = append(s.Durations, r.Elapsed)
+		}
+	}
+	return res
+}
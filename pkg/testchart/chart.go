@@ -17,6 +17,7 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -24,6 +25,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/karrick/godirwalk"
@@ -77,14 +80,27 @@ func (t *TestChart) RuntimeDefaults() map[string]interface{} {
 	return t.runtimeDefaults
 }
 
+func (t *TestChart) MergedValues() map[string]interface{} {
+	v, err := chartutil.CoalesceValues(t.chart(nil), map[string]interface{}{"Values": t.Values})
+	if err != nil {
+		return t.Values
+	}
+	values, _ := v["Values"].(map[string]interface{})
+	return values
+}
+
 func (t *TestChart) Cleanup() error {
 	return os.RemoveAll(t.tmpExecutionDir)
 }
 
-func downloadFile(filepath string, url string) error {
+func downloadFile(ctx context.Context, filepath string, url string) error {
 
 	// Get the data
-	resp, err := http.Get(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -132,6 +148,44 @@ func (t *TestChart) loadDefaults(chartpath string) error {
 	return nil
 }
 
+// runtimeReference matches the references in runtime.yaml which are
+// rendered by the runner, when the commands are expanded and run
+var runtimeReference = regexp.MustCompile(`{{-?\s*\.(Matrix|Steps)\.[^}\n]*}}`)
+
+// templateLine matches the position of template errors, as
+// "template: name/runtime.yaml:12:4:" or yaml ones as "yaml: line 12:"
+var templateLine = regexp.MustCompile(`(?:runtime\.yaml:|yaml: line )(\d+)`)
+
+// lineContext returns the lines of src around the given one, numbered,
+// with the given one marked
+func lineContext(src string, line int) string {
+	lines := strings.Split(strings.TrimRight(src, "\n"), "\n")
+	var b strings.Builder
+	for i := line - 3; i <= line+1; i++ {
+		if i < 0 || i >= len(lines) {
+			continue
+		}
+		marker := "  "
+		if i == line-1 {
+			marker = "> "
+		}
+		fmt.Fprintf(&b, "%s%4d | %s\n", marker, i+1, lines[i])
+	}
+	return b.String()
+}
+
+// withLineContext adds to err the lines of src it refers to
+func withLineContext(err error, src string) error {
+	m := templateLine.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	line, _ := strconv.Atoi(m[1])
+	return errors.Errorf("%s\n%s", err.Error(), lineContext(src, line))
+}
+
+// loadRuntimeDefaults renders runtime.yaml as the templates, with the
+// chart values, and reads the runtime options from it.
 func (t *TestChart) loadRuntimeDefaults(chartpath string) error {
 	var defaults values
 	runtime := filepath.Join(chartpath, "runtime.yaml")
@@ -141,8 +195,17 @@ func (t *TestChart) loadRuntimeDefaults(chartpath string) error {
 			return errors.Wrap(err, "while reading runtime file from test chart")
 		}
 
-		if err := yaml.Unmarshal(dat, &defaults); err != nil {
-			return errors.Wrap(err, "while unmarshalling runtime file from test chart")
+		// Matrix and outputs references are kept as they are
+		source := runtimeReference.ReplaceAllStringFunc(string(dat), func(ref string) string {
+			return "{{ " + strconv.Quote(ref) + " }}"
+		})
+		rendered, err := t.Render("runtime.yaml", source)
+		if err != nil {
+			return errors.Wrap(withLineContext(err, string(dat)), "while rendering runtime file from test chart")
+		}
+
+		if err := yaml.Unmarshal([]byte(rendered), &defaults); err != nil {
+			return errors.Wrap(withLineContext(err, rendered), "while unmarshalling rendered runtime file from test chart")
 		}
 
 		t.runtimeDefaults = defaults
@@ -249,7 +312,9 @@ func (t *TestChart) LoadMeta(chartpath string) error {
 	return nil
 }
 
-func (t *TestChart) Load(chartpath string) error {
+// Load renders the chart in the runner directory, the context allows to
+// abort downloads and rendering.
+func (t *TestChart) Load(ctx context.Context, chartpath string) error {
 
 	if isValidUrl(chartpath) {
 		tempdir, err := ioutil.TempDir(os.TempDir(), "charty")
@@ -260,7 +325,7 @@ func (t *TestChart) Load(chartpath string) error {
 		chart := filepath.Join(tempdir, "chart.tar.gz")
 
 		//download and extract
-		err = downloadFile(chart, chartpath)
+		err = downloadFile(ctx, chart, chartpath)
 		if err != nil {
 			return errors.Wrap(err, "while downloading chart")
 		}
@@ -311,6 +376,9 @@ func (t *TestChart) Load(chartpath string) error {
 	templates := filepath.Join(chartpath, "templates")
 	err := godirwalk.Walk(templates, &godirwalk.Options{
 		Callback: func(osPathname string, de *godirwalk.Dirent) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			relativepath := strings.ReplaceAll(osPathname, strings.TrimSuffix(chartpath, "/"), "")
 			relativepath = strings.ReplaceAll(relativepath, "/templates", "")
 			relativepath = strings.TrimPrefix(relativepath, "/")
@@ -355,17 +423,24 @@ func (t *TestChart) Load(chartpath string) error {
 	return nil
 }
 
-func (t *TestChart) render(template, id string) (string, error) {
-	c := &chart.Chart{
+func (t *TestChart) chart(templates []*chart.File) *chart.Chart {
+	return &chart.Chart{
 		Metadata: &chart.Metadata{
 			Name:    t.name,
 			Version: t.version,
 		},
-		Templates: []*chart.File{
-			{Name: id, Data: []byte(template)},
-		},
-		Values: map[string]interface{}{"Values": t.defaults},
+		Templates: templates,
+		Values:    map[string]interface{}{"Values": t.defaults},
 	}
+}
+
+func (t *TestChart) render(template, id string) (string, error) {
+	return t.Render(id, template)
+}
+
+// Render renders a template with the chart values.
+func (t *TestChart) Render(id, template string) (string, error) {
+	c := t.chart([]*chart.File{{Name: id, Data: []byte(template)}})
 
 	v, err := chartutil.CoalesceValues(c, map[string]interface{}{"Values": t.Values})
 	if err != nil {
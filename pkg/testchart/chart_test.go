@@ -13,7 +13,9 @@ limitations under the License.
 package chart_test
 
 import (
+	"context"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 
 	test "github.com/mudler/charty/pkg/testchart"
@@ -35,7 +37,7 @@ var _ = Describe("Chart", func() {
 		})
 
 		It("renders templates", func() {
-			err := testchart.Load("../../test/fixture")
+			err := testchart.Load(context.Background(), "../../test/fixture")
 			Expect(err).ToNot(HaveOccurred())
 
 			dat, err := ioutil.ReadFile(filepath.Join(testchart.RunnerDirectory(), "test.sh"))
@@ -45,12 +47,61 @@ var _ = Describe("Chart", func() {
 
 		It("overrides defaults", func() {
 			testchart.Values = map[string]interface{}{"foo": "foo"}
-			err := testchart.Load("../../test/fixture")
+			err := testchart.Load(context.Background(), "../../test/fixture")
 			Expect(err).ToNot(HaveOccurred())
 
 			dat, err := ioutil.ReadFile(filepath.Join(testchart.RunnerDirectory(), "test.sh"))
 			Expect(err).ToNot(HaveOccurred())
 			Expect(string(dat)).To(Equal(`echo "Foo testfoo"`))
 		})
+
+		It("merges values with defaults", func() {
+			testchart.Values = map[string]interface{}{"foo": "foo"}
+			err := testchart.Load(context.Background(), "../../test/fixture")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(testchart.MergedValues()).To(Equal(map[string]interface{}{"foo": "foo", "bar": "test", "fail": false}))
+		})
+
+		It("renders the runtime file", func() {
+			testchart.Values = map[string]interface{}{"e2e": true}
+			err := testchart.Load(context.Background(), "../../test/runtime")
+			Expect(err).ToNot(HaveOccurred())
+
+			runtime := testchart.RuntimeDefaults()
+			Expect(runtime["parallel"]).To(Equal(2))
+			var names, runs []string
+			for _, c := range runtime["commands"].([]interface{}) {
+				names = append(names, c.(map[interface{}]interface{})["name"].(string))
+				run, _ := c.(map[interface{}]interface{})["run"].(string)
+				runs = append(runs, run)
+			}
+			Expect(names).To(Equal([]string{"test-api", "test-ui", "e2e", "escaped", "report"}))
+			Expect(runs[0]).To(Equal("echo api"))
+			Expect(runs[4]).To(Equal("echo {{ .Matrix.format }} {{ .Steps.test-api.outputs.url }}"))
+
+			testchart.Values = map[string]interface{}{}
+			err = testchart.Load(context.Background(), "../../test/runtime")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(testchart.RuntimeDefaults()["commands"]).To(HaveLen(4))
+		})
+
+		It("points at the runtime file on errors", func() {
+			dir, err := ioutil.TempDir("", "charty")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			Expect(ioutil.WriteFile(filepath.Join(dir, "metadata.yaml"), []byte("name: broken\nversion: 0.1.0\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "values.yaml"), []byte("targets: []\n"), 0644)).To(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(dir, "runtime.yaml"), []byte("commands:\n- name: test\n  run: {{ .Values.targets | nope }}\n"), 0644)).To(Succeed())
+
+			err = testchart.LoadMeta(dir)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("runtime.yaml"))
+			Expect(err.Error()).To(ContainSubstring(">    3 |   run: {{ .Values.targets | nope }}"))
+
+			Expect(ioutil.WriteFile(filepath.Join(dir, "runtime.yaml"), []byte("commands:\n- name: test\n run: true\n"), 0644)).To(Succeed())
+			err = testchart.LoadMeta(dir)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring(">    2 | - name: test"))
+		})
 	})
 })
@@ -0,0 +1 @@
+echo "e2e on {{ join " " .Values.targets }}"